@@ -0,0 +1,152 @@
+package auth
+
+import (
+	"crypto/x509"
+	"errors"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// ErrUnauthorized the credentials were rejected
+var ErrUnauthorized = errors.New("unauthorized")
+
+// Credentials what a client presented in net/register
+type Credentials struct {
+	// ID requested tunnel ID
+	ID       string
+	User     string
+	Password string
+	Token    string
+	// Mode tunnel type of the control listener
+	Mode string
+	// Nonce and ClientID the net/challenge sent on connect, Response the
+	// client's ChallengeResponse to it
+	Nonce    string
+	ClientID string
+	Response string
+}
+
+// Permissions what an identity may do, empty fields allow everything
+type Permissions struct {
+	// Subdomains glob patterns of the tunnel IDs the identity may use
+	Subdomains  []string `toml:"subdomains" json:"subdomains"`
+	TunnelTypes []string `toml:"tunnel_types" json:"tunnel_types"`
+	MaxTunnels  int      `toml:"max_tunnels" json:"max_tunnels"`
+}
+
+// AllowsSubdomain reports whether the tunnel ID may be used
+func (p *Permissions) AllowsSubdomain(id string) bool {
+	if len(p.Subdomains) == 0 {
+		return true
+	}
+	for _, pattern := range p.Subdomains {
+		if ok, _ := path.Match(pattern, id); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsType reports whether the tunnel type may be used
+func (p *Permissions) AllowsType(mode string) bool {
+	if len(p.TunnelTypes) == 0 {
+		return true
+	}
+	for _, t := range p.TunnelTypes {
+		if t == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// Identity an authenticated user
+type Identity struct {
+	Name        string
+	Permissions Permissions
+	// secretHash the stored hash of the token or password the identity
+	// authenticated with, a changed hash revokes it
+	secretHash string
+	// source the authenticator that issued the identity
+	source string
+}
+
+// Anonymous identity of clients on servers without authentication
+func Anonymous() *Identity {
+	return &Identity{Name: "anonymous"}
+}
+
+// identity sources checked by Validator implementations
+const (
+	sourceTokens      = "tokens"
+	sourceHtpasswd    = "htpasswd"
+	sourceCertificate = "certificate"
+	sourceSSHKey      = "ssh-key"
+)
+
+// CertificateIdentity the identity of a verified client certificate, the
+// subject common name or the whole subject when it has none
+func CertificateIdentity(cert *x509.Certificate) *Identity {
+	name := cert.Subject.CommonName
+	if name == "" {
+		name = cert.Subject.String()
+	}
+	return &Identity{Name: name, source: sourceCertificate}
+}
+
+// Authenticator checks the credentials of a registering client
+type Authenticator interface {
+	Authenticate(creds *Credentials) (*Identity, error)
+}
+
+// Reloader an authenticator backed by a file that can be re-read
+type Reloader interface {
+	Reload() error
+	// Watch reloads the file whenever it changes
+	Watch(interval time.Duration)
+	// OnReload registers a function called after every reload
+	OnReload(fn func())
+}
+
+// Validator an authenticator that can revoke identities it issued,
+// identities issued elsewhere are always valid
+type Validator interface {
+	Valid(identity *Identity) bool
+}
+
+// reloadNotifier the reload subscribers of a file-backed authenticator
+type reloadNotifier struct {
+	subscribers []func()
+	mu          sync.Mutex
+}
+
+// OnReload registers a function called after every reload
+func (n *reloadNotifier) OnReload(fn func()) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.subscribers = append(n.subscribers, fn)
+}
+
+// notify calls the reload subscribers
+func (n *reloadNotifier) notify() {
+	n.mu.Lock()
+	subscribers := n.subscribers
+	n.mu.Unlock()
+	for _, fn := range subscribers {
+		fn()
+	}
+}
+
+// watchFile calls reload every time the file modification time changes
+func watchFile(path string, interval time.Duration, modTime time.Time, reload func() error) {
+	for range time.Tick(interval) {
+		info, err := os.Stat(path)
+		if err != nil || info.ModTime().Equal(modTime) {
+			continue
+		}
+		modTime = info.ModTime()
+		reload()
+	}
+}
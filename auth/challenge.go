@@ -0,0 +1,70 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+)
+
+// clientKeyLabel the message a secret is keyed over to derive its client key
+const clientKeyLabel = "prxpass client key"
+
+// ClientKey the key a client proves it knows: HMAC-SHA256 keyed with the
+// secret over "prxpass client key"
+func ClientKey(secret string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(clientKeyLabel))
+	return mac.Sum(nil)
+}
+
+// StoredKey the hex SHA-256 of the client key of a secret. It verifies
+// challenge responses but cannot compute them, so the server may store it.
+func StoredKey(secret string) string {
+	sum := sha256.Sum256(ClientKey(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// challengeSignature HMAC-SHA256 keyed with the stored key over the nonce
+// followed by the client ID
+func challengeSignature(storedKey []byte, nonce, clientID string) []byte {
+	mac := hmac.New(sha256.New, storedKey)
+	mac.Write([]byte(nonce))
+	mac.Write([]byte(clientID))
+	return mac.Sum(nil)
+}
+
+// ChallengeResponse the answer to a net/challenge: the hex client key of
+// the secret XORed with the challenge signature. The server recovers the
+// client key with the signature and checks it against the stored key.
+func ChallengeResponse(secret, nonce, clientID string) string {
+	clientKey := ClientKey(secret)
+	storedKey := sha256.Sum256(clientKey)
+	signature := challengeSignature(storedKey[:], nonce, clientID)
+	for i := range clientKey {
+		clientKey[i] ^= signature[i]
+	}
+	return hex.EncodeToString(clientKey)
+}
+
+// verifyResponse reports whether the response proves knowledge of the
+// client key of the hex stored key
+func (c *Credentials) verifyResponse(storedKey string) bool {
+	if c.Nonce == "" || c.Response == "" {
+		return false
+	}
+	stored, err := hex.DecodeString(storedKey)
+	if err != nil || len(stored) != sha256.Size {
+		return false
+	}
+	proof, err := hex.DecodeString(c.Response)
+	if err != nil || len(proof) != sha256.Size {
+		return false
+	}
+	signature := challengeSignature(stored, c.Nonce, c.ClientID)
+	for i := range proof {
+		proof[i] ^= signature[i]
+	}
+	sum := sha256.Sum256(proof)
+	return subtle.ConstantTimeCompare(sum[:], stored) == 1
+}
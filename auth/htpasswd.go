@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Htpasswd users of an Apache htpasswd file with bcrypt or {SHA} hashes
+type Htpasswd struct {
+	path    string
+	hashes  map[string]string
+	modTime time.Time
+	mu      sync.RWMutex
+	reloadNotifier
+}
+
+// LoadHtpasswd loads an htpasswd file
+func LoadHtpasswd(path string) (*Htpasswd, error) {
+	h := &Htpasswd{path: path}
+	if err := h.Reload(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Reload re-reads the htpasswd file and notifies the reload subscribers
+func (h *Htpasswd) Reload() error {
+	f, err := os.Open(h.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hashes := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		hashes[parts[0]] = parts[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	h.hashes = hashes
+	h.modTime = info.ModTime()
+	h.mu.Unlock()
+	h.notify()
+	return nil
+}
+
+// Watch reloads the htpasswd file whenever it changes
+func (h *Htpasswd) Watch(interval time.Duration) {
+	h.mu.RLock()
+	modTime := h.modTime
+	h.mu.RUnlock()
+	watchFile(h.path, interval, modTime, h.Reload)
+}
+
+// Authenticate checks the user and password against the file
+func (h *Htpasswd) Authenticate(creds *Credentials) (*Identity, error) {
+	h.mu.RLock()
+	hash, ok := h.hashes[creds.User]
+	h.mu.RUnlock()
+	if !ok || !checkHash(hash, creds.Password) {
+		return nil, ErrUnauthorized
+	}
+	return &Identity{Name: creds.User, secretHash: hash, source: sourceHtpasswd}, nil
+}
+
+// Valid reports whether the user is still in the file with the password
+// hash it authenticated with
+func (h *Htpasswd) Valid(identity *Identity) bool {
+	if identity.source != sourceHtpasswd {
+		return true
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	hash, ok := h.hashes[identity.Name]
+	return ok && hash == identity.secretHash
+}
+
+// checkHash compares a password with an htpasswd hash, other hash
+// formats like crypt and $apr1$ are not supported
+func checkHash(hash, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		expected := base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(hash[5:]), []byte(expected)) == 1
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+package auth
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHtpasswd(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("alice-pass"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha1.Sum([]byte("bob-pass"))
+	dir, err := ioutil.TempDir("", "htpasswd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "htpasswd")
+	data := "# users\n" +
+		"alice:" + string(bcryptHash) + "\n" +
+		"bob:{SHA}" + base64.StdEncoding.EncodeToString(sum[:]) + "\n" +
+		"carol:$apr1$salt$hash\n"
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	h, err := LoadHtpasswd(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		user     string
+		password string
+		ok       bool
+	}{
+		{name: "bcrypt", user: "alice", password: "alice-pass", ok: true},
+		{name: "bcrypt wrong password", user: "alice", password: "bob-pass"},
+		{name: "sha", user: "bob", password: "bob-pass", ok: true},
+		{name: "sha wrong password", user: "bob", password: "alice-pass"},
+		{name: "unsupported hash", user: "carol", password: "carol-pass"},
+		{name: "unknown user", user: "dave", password: "alice-pass"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity, err := h.Authenticate(&Credentials{User: tt.user, Password: tt.password})
+			if !tt.ok {
+				if err != ErrUnauthorized {
+					t.Fatalf("err = %v, want %v", err, ErrUnauthorized)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if identity.Name != tt.user {
+				t.Fatalf("name = %q, want %q", identity.Name, tt.user)
+			}
+			if !h.Valid(identity) {
+				t.Fatal("identity is not valid")
+			}
+		})
+	}
+}
+
+func TestHtpasswdValid(t *testing.T) {
+	sha := func(password string) string {
+		sum := sha1.Sum([]byte(password))
+		return "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	}
+	dir, err := ioutil.TempDir("", "htpasswd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "htpasswd")
+	write := func(data string) {
+		if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("alice:" + sha("alice-pass") + "\nbob:" + sha("bob-pass") + "\ncarol:" + sha("carol-pass") + "\n")
+	h, err := LoadHtpasswd(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identities := map[string]*Identity{}
+	for _, user := range []string{"alice", "bob", "carol"} {
+		identity, err := h.Authenticate(&Credentials{User: user, Password: user + "-pass"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		identities[user] = identity
+	}
+
+	// alice gets a new password, carol is removed
+	write("alice:" + sha("new-pass") + "\nbob:" + sha("bob-pass") + "\n")
+	if err := h.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	for user, want := range map[string]bool{"alice": false, "bob": true, "carol": false} {
+		if got := h.Valid(identities[user]); got != want {
+			t.Errorf("Valid(%s) = %v, want %v", user, got, want)
+		}
+	}
+	if !h.Valid(Anonymous()) {
+		t.Error("identities of other backends were revoked")
+	}
+}
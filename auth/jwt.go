@@ -0,0 +1,128 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"hash"
+	"strings"
+	"time"
+)
+
+// JWT accepts HMAC-signed JSON web tokens. The sub claim is the identity,
+// the subdomains, tunnel_types and max_tunnels claims its permissions.
+type JWT struct {
+	Secret   []byte
+	Issuer   string
+	Audience string
+}
+
+// jwtHeader JOSE header
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+}
+
+// jwtClaims registered and permission claims
+type jwtClaims struct {
+	Subject   string   `json:"sub"`
+	Issuer    string   `json:"iss"`
+	Audience  audience `json:"aud"`
+	ExpiresAt int64    `json:"exp"`
+	NotBefore int64    `json:"nbf"`
+	Permissions
+}
+
+// audience the aud claim, a string or a list of strings
+type audience []string
+
+// UnmarshalJSON accepts both forms of the aud claim
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+// jwtAlgorithms supported signing algorithms
+var jwtAlgorithms = map[string]func() hash.Hash{
+	"HS256": sha256.New,
+	"HS384": sha512.New384,
+	"HS512": sha512.New,
+}
+
+// Authenticate verifies the token signature and claims
+func (j *JWT) Authenticate(creds *Credentials) (*Identity, error) {
+	parts := strings.Split(creds.Token, ".")
+	if len(parts) != 3 {
+		return nil, ErrUnauthorized
+	}
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrUnauthorized
+	}
+	newHash, ok := jwtAlgorithms[header.Alg]
+	if !ok {
+		return nil, ErrUnauthorized
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrUnauthorized
+	}
+	mac := hmac.New(newHash, j.Secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, ErrUnauthorized
+	}
+	var claims jwtClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrUnauthorized
+	}
+	if !j.validClaims(&claims, time.Now().Unix()) {
+		return nil, ErrUnauthorized
+	}
+	return &Identity{Name: claims.Subject, Permissions: claims.Permissions}, nil
+}
+
+// validClaims checks the time window, issuer and audience
+func (j *JWT) validClaims(claims *jwtClaims, now int64) bool {
+	if claims.Subject == "" {
+		return false
+	}
+	if claims.ExpiresAt != 0 && now >= claims.ExpiresAt {
+		return false
+	}
+	if claims.NotBefore != 0 && now < claims.NotBefore {
+		return false
+	}
+	if j.Issuer != "" && claims.Issuer != j.Issuer {
+		return false
+	}
+	if j.Audience != "" {
+		for _, aud := range claims.Audience {
+			if aud == j.Audience {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// decodeSegment decodes a base64url JSON segment
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
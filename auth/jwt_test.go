@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// signJWT builds an HS256 token, alg overrides the header algorithm
+func signJWT(t *testing.T, secret, alg string, claims map[string]interface{}) string {
+	header, err := json.Marshal(jwtHeader{Alg: alg, Typ: "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestJWT(t *testing.T) {
+	j := &JWT{Secret: []byte("secret"), Issuer: "prxpass", Audience: "tunnels"}
+	now := time.Now().Unix()
+	claims := func(extra map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"sub": "alice",
+			"iss": "prxpass",
+			"aud": "tunnels",
+			"exp": now + 60,
+		}
+		for k, v := range extra {
+			c[k] = v
+		}
+		return c
+	}
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{name: "valid", token: signJWT(t, "secret", "HS256", claims(nil)), ok: true},
+		{name: "audience list", token: signJWT(t, "secret", "HS256", claims(map[string]interface{}{"aud": []string{"other", "tunnels"}})), ok: true},
+		{name: "wrong secret", token: signJWT(t, "other", "HS256", claims(nil))},
+		{name: "alg none", token: signJWT(t, "secret", "none", claims(nil))},
+		{name: "alg mismatch", token: signJWT(t, "secret", "HS512", claims(nil))},
+		{name: "expired", token: signJWT(t, "secret", "HS256", claims(map[string]interface{}{"exp": now - 1}))},
+		{name: "not yet valid", token: signJWT(t, "secret", "HS256", claims(map[string]interface{}{"nbf": now + 60}))},
+		{name: "wrong issuer", token: signJWT(t, "secret", "HS256", claims(map[string]interface{}{"iss": "other"}))},
+		{name: "wrong audience", token: signJWT(t, "secret", "HS256", claims(map[string]interface{}{"aud": "other"}))},
+		{name: "no subject", token: signJWT(t, "secret", "HS256", claims(map[string]interface{}{"sub": ""}))},
+		{name: "malformed", token: "not.a-token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity, err := j.Authenticate(&Credentials{Token: tt.token})
+			if !tt.ok {
+				if err != ErrUnauthorized {
+					t.Fatalf("err = %v, want %v", err, ErrUnauthorized)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if identity.Name != "alice" {
+				t.Fatalf("name = %q, want %q", identity.Name, "alice")
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package auth
+
+import (
+	"bytes"
+	"io/ioutil"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// AuthorizedKeys SSH public keys in authorized_keys format. The key
+// comment names the user, keys without one are named by fingerprint.
+type AuthorizedKeys struct {
+	path string
+}
+
+// NewAuthorizedKeys creates an authorized keys lookup, the file is read
+// on every login so removed keys stop working without a restart
+func NewAuthorizedKeys(path string) *AuthorizedKeys {
+	return &AuthorizedKeys{path: path}
+}
+
+// Authenticate finds the user of a public key
+func (k *AuthorizedKeys) Authenticate(key ssh.PublicKey) (*Identity, error) {
+	data, err := ioutil.ReadFile(k.path)
+	if err != nil {
+		return nil, err
+	}
+	wanted := key.Marshal()
+	for len(data) > 0 {
+		parsed, comment, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			break
+		}
+		data = rest
+		if !bytes.Equal(parsed.Marshal(), wanted) {
+			continue
+		}
+		if comment == "" {
+			comment = ssh.FingerprintSHA256(parsed)
+		}
+		return &Identity{Name: comment, source: sourceSSHKey}, nil
+	}
+	return nil, ErrUnauthorized
+}
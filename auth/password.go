@@ -0,0 +1,32 @@
+package auth
+
+import (
+	"crypto/subtle"
+)
+
+// Passwords the legacy shared password per tunnel type
+type Passwords struct {
+	Secrets map[string]string
+	// RequireChallenge refuses passwords sent in clear text
+	RequireChallenge bool
+}
+
+// Authenticate checks the challenge response or compares the password of
+// the tunnel type in constant time, tunnel types without a password are
+// open
+func (p *Passwords) Authenticate(creds *Credentials) (*Identity, error) {
+	password := p.Secrets[creds.Mode]
+	if password == "" {
+		return Anonymous(), nil
+	}
+	if creds.Response != "" {
+		if !creds.verifyResponse(StoredKey(password)) {
+			return nil, ErrUnauthorized
+		}
+		return Anonymous(), nil
+	}
+	if p.RequireChallenge || subtle.ConstantTimeCompare([]byte(creds.Password), []byte(password)) != 1 {
+		return nil, ErrUnauthorized
+	}
+	return Anonymous(), nil
+}
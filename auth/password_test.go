@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"testing"
+)
+
+func TestPasswords(t *testing.T) {
+	secrets := map[string]string{"http": "http-pass", "tcp": ""}
+	challenge := func(secret string) *Credentials {
+		return &Credentials{
+			Mode:     "http",
+			Nonce:    "nonce",
+			ClientID: "client",
+			Response: ChallengeResponse(secret, "nonce", "client"),
+		}
+	}
+	tests := []struct {
+		name      string
+		challenge bool
+		creds     *Credentials
+		ok        bool
+	}{
+		{name: "password", creds: &Credentials{Mode: "http", Password: "http-pass"}, ok: true},
+		{name: "wrong password", creds: &Credentials{Mode: "http", Password: "nope"}},
+		{name: "missing password", creds: &Credentials{Mode: "http"}},
+		{name: "open tunnel type", creds: &Credentials{Mode: "tcp"}, ok: true},
+		{name: "unconfigured tunnel type", creds: &Credentials{Mode: "udp", Password: "x"}, ok: true},
+		{name: "challenge", creds: challenge("http-pass"), ok: true},
+		{name: "wrong challenge", creds: challenge("nope")},
+		{name: "challenge required", challenge: true, creds: challenge("http-pass"), ok: true},
+		{name: "clear text refused", challenge: true, creds: &Credentials{Mode: "http", Password: "http-pass"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Passwords{Secrets: secrets, RequireChallenge: tt.challenge}
+			identity, err := p.Authenticate(tt.creds)
+			if !tt.ok {
+				if err != ErrUnauthorized {
+					t.Fatalf("err = %v, want %v", err, ErrUnauthorized)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if identity.Name != "anonymous" {
+				t.Fatalf("name = %q, want %q", identity.Name, "anonymous")
+			}
+		})
+	}
+}
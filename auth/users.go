@@ -0,0 +1,128 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// HashToken hex SHA-256 of a secret token
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// User a users file entry, only hashes of the token are stored. The
+// stored key, see StoredKey, lets the user answer the challenge.
+type User struct {
+	Name      string
+	TokenHash string `toml:"token_hash"`
+	StoredKey string `toml:"stored_key"`
+	Disabled  bool
+	Permissions
+}
+
+// usersFile TOML users file
+type usersFile struct {
+	User []User `toml:"user"`
+}
+
+// Users API tokens loaded from a users file
+type Users struct {
+	// RequireChallenge refuses tokens sent in clear text
+	RequireChallenge bool
+	path             string
+	users            []User
+	modTime          time.Time
+	mu               sync.RWMutex
+	reloadNotifier
+}
+
+// LoadUsers loads a users file
+func LoadUsers(path string) (*Users, error) {
+	u := &Users{path: path}
+	if err := u.Reload(); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// Reload re-reads the users file and notifies the reload subscribers
+func (u *Users) Reload() error {
+	info, err := os.Stat(u.path)
+	if err != nil {
+		return err
+	}
+	var file usersFile
+	if _, err := toml.DecodeFile(u.path, &file); err != nil {
+		return err
+	}
+	u.mu.Lock()
+	u.users = file.User
+	u.modTime = info.ModTime()
+	u.mu.Unlock()
+	u.notify()
+	return nil
+}
+
+// Watch reloads the users file whenever it changes, so revoked tokens
+// stop working without a restart
+func (u *Users) Watch(interval time.Duration) {
+	u.mu.RLock()
+	modTime := u.modTime
+	u.mu.RUnlock()
+	watchFile(u.path, interval, modTime, u.Reload)
+}
+
+// Authenticate finds the user of the token. Every entry is compared in
+// constant time so the timing does not leak which hashes exist. A
+// challenge response is checked against the stored key, users without
+// one can only send the token in clear text.
+func (u *Users) Authenticate(creds *Credentials) (*Identity, error) {
+	if creds.Response == "" && u.RequireChallenge {
+		return nil, ErrUnauthorized
+	}
+	hash := []byte(HashToken(creds.Token))
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	var found *User
+	for i := range u.users {
+		match := subtle.ConstantTimeCompare(hash, []byte(u.users[i].TokenHash)) == 1
+		if creds.Response != "" {
+			match = creds.verifyResponse(u.users[i].StoredKey)
+		}
+		if match && !u.users[i].Disabled {
+			found = &u.users[i]
+		}
+	}
+	if found == nil {
+		return nil, ErrUnauthorized
+	}
+	return &Identity{
+		Name:        found.Name,
+		Permissions: found.Permissions,
+		secretHash:  found.TokenHash,
+		source:      sourceTokens,
+	}, nil
+}
+
+// Valid reports whether the token an identity authenticated with is
+// still active
+func (u *Users) Valid(identity *Identity) bool {
+	if identity.source != sourceTokens {
+		return true
+	}
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	for _, user := range u.users {
+		if user.Name == identity.Name && user.TokenHash == identity.secretHash && !user.Disabled {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// DefaultWebhookTimeout how long the auth webhook may take to answer
+const DefaultWebhookTimeout = 5 * time.Second
+
+// Webhook asks an external HTTP service to authenticate clients. The
+// credentials are POSTed as JSON, a 200 answer carries the identity and
+// 401 or 403 rejects the client.
+type Webhook struct {
+	URL    string
+	Client *http.Client
+}
+
+// NewWebhook creates a webhook authenticator
+func NewWebhook(url string, timeout time.Duration) *Webhook {
+	if timeout <= 0 {
+		timeout = DefaultWebhookTimeout
+	}
+	return &Webhook{
+		URL:    url,
+		Client: &http.Client{Timeout: timeout},
+	}
+}
+
+// webhookRequest the body POSTed to the webhook
+type webhookRequest struct {
+	ID       string `json:"id"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+	Token    string `json:"token"`
+	Mode     string `json:"mode"`
+	Nonce    string `json:"nonce,omitempty"`
+	ClientID string `json:"client_id,omitempty"`
+	Response string `json:"response,omitempty"`
+}
+
+// webhookResponse the body of an accepting answer
+type webhookResponse struct {
+	Name string `json:"name"`
+	Permissions
+}
+
+// Authenticate posts the credentials to the webhook
+func (w *Webhook) Authenticate(creds *Credentials) (*Identity, error) {
+	body, err := json.Marshal(webhookRequest{
+		ID:       creds.ID,
+		User:     creds.User,
+		Password: creds.Password,
+		Token:    creds.Token,
+		Mode:     creds.Mode,
+		Nonce:    creds.Nonce,
+		ClientID: creds.ClientID,
+		Response: creds.Response,
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := w.Client.Post(w.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return nil, ErrUnauthorized
+	default:
+		return nil, fmt.Errorf("auth webhook: unexpected status %d", resp.StatusCode)
+	}
+	var result webhookResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	if result.Name == "" {
+		result.Name = creds.User
+	}
+	return &Identity{Name: result.Name, Permissions: result.Permissions}, nil
+}
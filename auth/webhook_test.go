@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestWebhook(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   *Identity
+		err    bool
+	}{
+		{
+			name:   "accepted",
+			status: http.StatusOK,
+			body:   `{"name": "alice", "subdomains": ["alice-*"], "max_tunnels": 2}`,
+			want: &Identity{Name: "alice", Permissions: Permissions{
+				Subdomains: []string{"alice-*"},
+				MaxTunnels: 2,
+			}},
+		},
+		{
+			name:   "accepted without a name",
+			status: http.StatusOK,
+			body:   `{}`,
+			want:   &Identity{Name: "bob"},
+		},
+		{name: "unauthorized", status: http.StatusUnauthorized, err: true},
+		{name: "forbidden", status: http.StatusForbidden, err: true},
+		{name: "server error", status: http.StatusInternalServerError, err: true},
+		{name: "bad JSON", status: http.StatusOK, body: `{"name":`, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got webhookRequest
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+					t.Errorf("decode request: %v", err)
+				}
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+
+			creds := &Credentials{ID: "demo", User: "bob", Password: "secret", Mode: "http"}
+			identity, err := NewWebhook(srv.URL, 0).Authenticate(creds)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("identity = %+v, want an error", identity)
+				}
+				if tt.status == http.StatusUnauthorized || tt.status == http.StatusForbidden {
+					if err != ErrUnauthorized {
+						t.Fatalf("err = %v, want %v", err, ErrUnauthorized)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(identity, tt.want) {
+				t.Fatalf("identity = %+v, want %+v", identity, tt.want)
+			}
+			want := webhookRequest{ID: "demo", User: "bob", Password: "secret", Mode: "http"}
+			if got != want {
+				t.Fatalf("request = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+// Package capture keeps recent HTTP exchanges of tunnels for inspection
+package capture
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultSize exchanges kept when the size is not configured
+	DefaultSize = 100
+	// DefaultMaxBody bytes of each body kept when not configured
+	DefaultMaxBody = 64 << 10
+)
+
+// Exchange a proxied request and its response. Bodies are cut at the
+// buffer's max body size. ResponseProto is the protocol of the tunnel
+// client's response, empty when the client did not send one.
+type Exchange struct {
+	ID                uint64        `json:"id"`
+	Tunnel            string        `json:"tunnel"`
+	Start             time.Time     `json:"start"`
+	Duration          time.Duration `json:"duration"`
+	Remote            string        `json:"remote"`
+	Method            string        `json:"method"`
+	URL               string        `json:"url"`
+	Proto             string        `json:"proto"`
+	RequestHeaders    http.Header   `json:"request_headers"`
+	RequestBody       []byte        `json:"request_body"`
+	RequestTruncated  bool          `json:"request_truncated"`
+	Status            int           `json:"status"`
+	ResponseProto     string        `json:"response_proto,omitempty"`
+	ResponseHeaders   http.Header   `json:"response_headers"`
+	ResponseBody      []byte        `json:"response_body"`
+	ResponseTruncated bool          `json:"response_truncated"`
+	// ReplayOf the exchange this one replayed, zero for visitors
+	ReplayOf uint64 `json:"replay_of,omitempty"`
+}
+
+// replayKey the request context key of WithReplayOf
+type replayKey struct{}
+
+// WithReplayOf marks a request as a replay of the exchange id
+func WithReplayOf(r *http.Request, id uint64) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), replayKey{}, id))
+}
+
+// ReplayOf the exchange a request replays, zero for visitors
+func ReplayOf(r *http.Request) uint64 {
+	id, _ := r.Context().Value(replayKey{}).(uint64)
+	return id
+}
+
+// Buffer a ring buffer of the most recent exchanges of all tunnels
+type Buffer struct {
+	mu        sync.RWMutex
+	exchanges []*Exchange
+	next      int
+	lastID    uint64
+	maxBody   int
+}
+
+// NewBuffer creates a buffer of size exchanges, zero values use the
+// defaults
+func NewBuffer(size, maxBody int) *Buffer {
+	if size <= 0 {
+		size = DefaultSize
+	}
+	if maxBody <= 0 {
+		maxBody = DefaultMaxBody
+	}
+	return &Buffer{
+		exchanges: make([]*Exchange, size),
+		maxBody:   maxBody,
+	}
+}
+
+// NewBody creates a body recorder limited to the max body size
+func (b *Buffer) NewBody() *Body {
+	return &Body{max: b.maxBody}
+}
+
+// Add stores an exchange, overwriting the oldest one once full
+func (b *Buffer) Add(e *Exchange) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lastID++
+	e.ID = b.lastID
+	b.exchanges[b.next] = e
+	b.next = (b.next + 1) % len(b.exchanges)
+}
+
+// List the exchanges of a tunnel, newest first. An empty tunnel lists
+// every tunnel.
+func (b *Buffer) List(tunnel string) []*Exchange {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	list := []*Exchange{}
+	for i := 1; i <= len(b.exchanges); i++ {
+		e := b.exchanges[(b.next-i+len(b.exchanges))%len(b.exchanges)]
+		if e == nil {
+			break
+		}
+		if tunnel == "" || e.Tunnel == tunnel {
+			list = append(list, e)
+		}
+	}
+	return list
+}
+
+// Get finds an exchange by ID
+func (b *Buffer) Get(id uint64) (*Exchange, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, e := range b.exchanges {
+		if e != nil && e.ID == id {
+			return e, true
+		}
+	}
+	return nil, false
+}
+
+// Body records the first bytes written to it. A request body may still
+// be written while the exchange is stored, so it is safe for concurrent
+// use.
+type Body struct {
+	mu        sync.Mutex
+	max       int
+	buf       bytes.Buffer
+	truncated bool
+}
+
+// Write keeps what fits and never fails
+func (b *Body) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	room := b.max - b.buf.Len()
+	if len(p) > room {
+		b.buf.Write(p[:room])
+		b.truncated = true
+		return len(p), nil
+	}
+	b.buf.Write(p)
+	return len(p), nil
+}
+
+// Bytes a copy of the recorded bytes and whether more were written
+func (b *Body) Bytes() ([]byte, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...), b.truncated
+}
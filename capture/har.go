@@ -0,0 +1,242 @@
+package capture
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// HAR an HTTP Archive 1.2 document
+type HAR struct {
+	Log HARLog `json:"log"`
+}
+
+// HARLog the log of a HAR document
+type HARLog struct {
+	Version string     `json:"version"`
+	Creator HARCreator `json:"creator"`
+	Entries []HAREntry `json:"entries"`
+}
+
+// HARCreator the application that wrote the log
+type HARCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// HAREntry an exchange in a HAR log
+type HAREntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         HARRequest  `json:"request"`
+	Response        HARResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HARTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+// HARRequest a request in a HAR log
+type HARRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARCookie    `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	QueryString []HARNameValue `json:"queryString"`
+	PostData    *HARPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+// HARResponse a response in a HAR log
+type HARResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARCookie    `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	Content     HARContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+// HARNameValue a header or query parameter
+type HARNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// HARCookie a cookie sent or set
+type HARCookie struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Path     string `json:"path,omitempty"`
+	Domain   string `json:"domain,omitempty"`
+	Expires  string `json:"expires,omitempty"`
+	HTTPOnly bool   `json:"httpOnly,omitempty"`
+	Secure   bool   `json:"secure,omitempty"`
+}
+
+// HARPostData a request body, binary bodies are base64 encoded
+type HARPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+// HARContent a response body, binary bodies are base64 encoded
+type HARContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+// HARTimings the phases of an exchange in milliseconds. The proxy only
+// sees the whole exchange, it is reported as waiting.
+type HARTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// truncatedComment notes a body cut at the max body size
+const truncatedComment = "truncated by the capture buffer"
+
+// NewHAR converts exchanges to a HAR log, oldest first
+func NewHAR(exchanges []*Exchange) *HAR {
+	sorted := append([]*Exchange(nil), exchanges...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Start.Before(sorted[j].Start)
+	})
+	entries := make([]HAREntry, 0, len(sorted))
+	for _, e := range sorted {
+		entries = append(entries, harEntry(e))
+	}
+	return &HAR{Log: HARLog{
+		Version: "1.2",
+		Creator: HARCreator{Name: "prxpass-server", Version: "1"},
+		Entries: entries,
+	}}
+}
+
+func harEntry(e *Exchange) HAREntry {
+	ms := float64(e.Duration) / float64(time.Millisecond)
+	entry := HAREntry{
+		StartedDateTime: e.Start.UTC().Format("2006-01-02T15:04:05.000Z07:00"),
+		Time:            ms,
+		Request: HARRequest{
+			Method:      e.Method,
+			URL:         e.URL,
+			HTTPVersion: e.Proto,
+			Cookies:     harCookies((&http.Request{Header: e.RequestHeaders}).Cookies()),
+			Headers:     harHeaders(e.RequestHeaders),
+			QueryString: harQuery(e.URL),
+			HeadersSize: -1,
+			BodySize:    len(e.RequestBody),
+		},
+		Response: HARResponse{
+			Status:      e.Status,
+			StatusText:  http.StatusText(e.Status),
+			HTTPVersion: e.ResponseProto,
+			Cookies:     harCookies((&http.Response{Header: e.ResponseHeaders}).Cookies()),
+			Headers:     harHeaders(e.ResponseHeaders),
+			Content: HARContent{
+				Size:     len(e.ResponseBody),
+				MimeType: e.ResponseHeaders.Get("Content-Type"),
+			},
+			RedirectURL: e.ResponseHeaders.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    len(e.ResponseBody),
+		},
+		Timings: HARTimings{Send: 0, Wait: ms, Receive: 0},
+	}
+	if e.ReplayOf != 0 {
+		entry.Comment = "replay"
+	}
+	if len(e.RequestBody) > 0 || e.RequestTruncated {
+		entry.Request.PostData = &HARPostData{
+			MimeType: e.RequestHeaders.Get("Content-Type"),
+		}
+		entry.Request.PostData.Text, entry.Request.PostData.Encoding = harText(e.RequestBody)
+		if e.RequestTruncated {
+			entry.Request.PostData.Comment = truncatedComment
+		}
+	}
+	content := &entry.Response.Content
+	content.Text, content.Encoding = harText(e.ResponseBody)
+	if e.ResponseTruncated {
+		content.Comment = truncatedComment
+	}
+	return entry
+}
+
+// harText a body as HAR text and its encoding, base64 unless it is UTF-8
+func harText(body []byte) (string, string) {
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+func harHeaders(h http.Header) []HARNameValue {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	headers := []HARNameValue{}
+	for _, name := range names {
+		for _, value := range h[name] {
+			headers = append(headers, HARNameValue{Name: name, Value: value})
+		}
+	}
+	return headers
+}
+
+func harQuery(rawURL string) []HARNameValue {
+	query := []HARNameValue{}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return query
+	}
+	for _, pair := range strings.Split(u.RawQuery, "&") {
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		name, _ := url.QueryUnescape(kv[0])
+		value := ""
+		if len(kv) > 1 {
+			value, _ = url.QueryUnescape(kv[1])
+		}
+		query = append(query, HARNameValue{Name: name, Value: value})
+	}
+	return query
+}
+
+func harCookies(cookies []*http.Cookie) []HARCookie {
+	list := []HARCookie{}
+	for _, c := range cookies {
+		cookie := HARCookie{
+			Name:     c.Name,
+			Value:    c.Value,
+			Path:     c.Path,
+			Domain:   c.Domain,
+			HTTPOnly: c.HttpOnly,
+			Secure:   c.Secure,
+		}
+		if !c.Expires.IsZero() {
+			cookie.Expires = c.Expires.UTC().Format(time.RFC3339)
+		}
+		list = append(list, cookie)
+	}
+	return list
+}
@@ -0,0 +1,277 @@
+package admin
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Defman21/prxpass-server/capture"
+	"github.com/Defman21/prxpass-server/common"
+	"github.com/Defman21/prxpass-server/metrics"
+	"github.com/Defman21/prxpass-server/types"
+	"github.com/gorilla/mux"
+)
+
+// ErrNoToken the admin API has no token configured
+var ErrNoToken = errors.New("admin.token is not configured")
+
+// Tunnel a tunnel as listed by the admin API
+type Tunnel struct {
+	ID             string    `json:"id"`
+	Owner          string    `json:"owner"`
+	Remote         string    `json:"remote"`
+	Type           string    `json:"type"`
+	ConnectedSince time.Time `json:"connected_since"`
+	BytesIn        uint64    `json:"bytes_in"`
+	BytesOut       uint64    `json:"bytes_out"`
+}
+
+// TunnelDetails a single tunnel with its protocol state
+type TunnelDetails struct {
+	Tunnel
+	Version  int       `json:"version"`
+	Features []string  `json:"features"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// Request a captured request as listed by the admin API, see
+// GET /api/requests/{id} for headers and bodies
+type Request struct {
+	ID       uint64        `json:"id"`
+	Tunnel   string        `json:"tunnel"`
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"`
+	Method   string        `json:"method"`
+	URL      string        `json:"url"`
+	Status   int           `json:"status"`
+	ReplayOf uint64        `json:"replay_of,omitempty"`
+}
+
+// notice the body of a broadcast
+type notice struct {
+	Message string `json:"message"`
+}
+
+// noticeResult how many clients got a broadcast
+type noticeResult struct {
+	Sent   int `json:"sent"`
+	Failed int `json:"failed"`
+}
+
+// API the admin REST API
+type API struct {
+	registry *types.Registry
+	captures *capture.Buffer
+	proxy    http.Handler
+	// tokenSum SHA-256 of the token, digests compare in constant time
+	// whatever the length of the presented token
+	tokenSum [sha256.Size]byte
+	router   *mux.Router
+}
+
+// NewAPI creates the admin API, every request but the dashboard page
+// needs the bearer token. Captures may be nil when capturing is disabled,
+// proxy replays captured requests and may be nil without HTTP tunnels.
+func NewAPI(registry *types.Registry, captures *capture.Buffer, proxy http.Handler, token string) *API {
+	a := &API{
+		registry: registry,
+		captures: captures,
+		proxy:    proxy,
+		tokenSum: sha256.Sum256([]byte(token)),
+		router:   mux.NewRouter(),
+	}
+	api := a.router.PathPrefix("/api").Subrouter()
+	api.HandleFunc("/tunnels", a.list).Methods(http.MethodGet)
+	api.HandleFunc("/tunnels/{id}", a.details).Methods(http.MethodGet)
+	api.HandleFunc("/tunnels/{id}", a.disconnect).Methods(http.MethodDelete)
+	api.HandleFunc("/tunnels/{id}/requests", a.requests).Methods(http.MethodGet)
+	api.HandleFunc("/requests/{id:[0-9]+}", a.request).Methods(http.MethodGet)
+	api.HandleFunc("/requests/{id:[0-9]+}/replay", a.replay).Methods(http.MethodPost)
+	api.HandleFunc("/har", a.har).Methods(http.MethodGet)
+	api.HandleFunc("/notice", a.broadcast).Methods(http.MethodPost)
+	a.router.Handle("/metrics", metrics.Handler()).Methods(http.MethodGet)
+	a.router.HandleFunc("/", dashboard).Methods(http.MethodGet)
+	return a
+}
+
+// Router the router of the API, for mounting more admin pages
+func (a *API) Router() *mux.Router {
+	return a.router
+}
+
+// ServeHTTP checks the bearer token and serves the request
+func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/" {
+		// the page holds no data, it asks for the token itself
+		a.router.ServeHTTP(w, r)
+		return
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	sum := sha256.Sum256([]byte(token))
+	if subtle.ConstantTimeCompare(sum[:], a.tokenSum[:]) != 1 {
+		common.Logger.Warnw("Admin: Unauthorized request",
+			"remote", r.RemoteAddr,
+			"path", r.URL.Path,
+		)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="prxpass"`)
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	a.router.ServeHTTP(w, r)
+}
+
+// Handle serves the admin API on its own listener
+func Handle(registry *types.Registry, captures *capture.Buffer, proxy http.Handler, config *types.AdminConfig) error {
+	if config.Token == "" {
+		return ErrNoToken
+	}
+	common.Logger.Infow("Listening [admin]",
+		"server", config.Server,
+	)
+	return http.ListenAndServe(config.Server, NewAPI(registry, captures, proxy, config.Token))
+}
+
+// tunnel describes a registered client
+func tunnel(id string, cl *types.Client) Tunnel {
+	in, out := cl.Traffic()
+	t := Tunnel{
+		ID:             id,
+		Remote:         cl.Conn.RemoteAddr().String(),
+		Type:           cl.Mode,
+		ConnectedSince: cl.ConnectedAt,
+		BytesIn:        in,
+		BytesOut:       out,
+	}
+	if cl.Identity != nil {
+		t.Owner = cl.Identity.Name
+	}
+	return t
+}
+
+func (a *API) list(w http.ResponseWriter, r *http.Request) {
+	tunnels := []Tunnel{}
+	for _, id := range a.registry.List() {
+		if cl, ok := a.registry.Lookup(id); ok {
+			tunnels = append(tunnels, tunnel(id, cl))
+		}
+	}
+	writeJSON(w, http.StatusOK, tunnels)
+}
+
+func (a *API) details(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	cl, ok := a.registry.Lookup(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, "tunnel not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, TunnelDetails{
+		Tunnel:   tunnel(id, cl),
+		Version:  cl.Version(),
+		Features: cl.Features(),
+		LastSeen: cl.LastSeen(),
+	})
+}
+
+// disconnect closes the connection of a tunnel and drops it from the
+// registry right away
+func (a *API) disconnect(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	cl, ok := a.registry.Lookup(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, "tunnel not found")
+		return
+	}
+	cl.Conn.Close()
+	a.registry.Unregister(id, cl)
+	common.Logger.Warnw("Admin: Tunnel disconnected",
+		"id", id,
+		"remote", r.RemoteAddr,
+	)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// requests lists the captured requests of a tunnel, newest first
+func (a *API) requests(w http.ResponseWriter, r *http.Request) {
+	if a.captures == nil {
+		writeError(w, http.StatusNotFound, "capture is disabled")
+		return
+	}
+	requests := []Request{}
+	for _, e := range a.captures.List(mux.Vars(r)["id"]) {
+		requests = append(requests, Request{
+			ID:       e.ID,
+			Tunnel:   e.Tunnel,
+			Start:    e.Start,
+			Duration: e.Duration,
+			Method:   e.Method,
+			URL:      e.URL,
+			Status:   e.Status,
+			ReplayOf: e.ReplayOf,
+		})
+	}
+	writeJSON(w, http.StatusOK, requests)
+}
+
+// request a captured request with its headers and bodies
+func (a *API) request(w http.ResponseWriter, r *http.Request) {
+	if e, ok := a.exchange(w, r); ok {
+		writeJSON(w, http.StatusOK, e)
+	}
+}
+
+// exchange the captured request of the URL, it writes the error when
+// there is none
+func (a *API) exchange(w http.ResponseWriter, r *http.Request) (*capture.Exchange, bool) {
+	if a.captures == nil {
+		writeError(w, http.StatusNotFound, "capture is disabled")
+		return nil, false
+	}
+	id, _ := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	e, ok := a.captures.Get(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, "request not found")
+	}
+	return e, ok
+}
+
+// broadcast sends a notice to every connected client
+func (a *API) broadcast(w http.ResponseWriter, r *http.Request) {
+	var n notice
+	if err := json.NewDecoder(r.Body).Decode(&n); err != nil || n.Message == "" {
+		writeError(w, http.StatusBadRequest, "expected {\"message\": ...}")
+		return
+	}
+	var result noticeResult
+	for _, id := range a.registry.List() {
+		cl, ok := a.registry.Lookup(id)
+		if !ok {
+			continue
+		}
+		if err := cl.Notice(n.Message); err != nil {
+			result.Failed++
+			continue
+		}
+		result.Sent++
+	}
+	common.Logger.Infow("Admin: Notice broadcast",
+		"sent", result.Sent,
+		"failed", result.Failed,
+	)
+	writeJSON(w, http.StatusOK, result)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
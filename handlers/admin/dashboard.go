@@ -0,0 +1,187 @@
+package admin
+
+import (
+	"net/http"
+)
+
+// dashboard serves the request inspector page. It keeps the admin token
+// in the browser's local storage and calls the API with it.
+func dashboard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	// captured data is only ever inserted as text, the policy is a
+	// second line of defence
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Write([]byte(dashboardHTML))
+}
+
+const dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>prxpass inspector</title>
+<style>
+body { margin: 0; font: 13px sans-serif; color: #222; display: flex; height: 100vh; }
+nav { width: 200px; border-right: 1px solid #ddd; overflow-y: auto; }
+#requests { width: 420px; border-right: 1px solid #ddd; overflow-y: auto; }
+#details { flex: 1; overflow-y: auto; padding: 0 12px; }
+h2 { font-size: 13px; margin: 0; padding: 8px; background: #f4f4f4; border-bottom: 1px solid #ddd; }
+ul { list-style: none; margin: 0; padding: 0; }
+li { padding: 6px 8px; border-bottom: 1px solid #eee; cursor: pointer; white-space: nowrap; overflow: hidden; text-overflow: ellipsis; }
+li:hover { background: #f8f8f8; }
+li.selected { background: #e6f0ff; }
+.muted { color: #888; }
+.error { color: #b00; }
+.status { display: inline-block; width: 32px; font-weight: bold; }
+table { border-collapse: collapse; margin-bottom: 8px; }
+td { padding: 2px 8px 2px 0; vertical-align: top; font-family: monospace; word-break: break-all; }
+td:first-child { color: #555; white-space: nowrap; }
+pre { background: #f8f8f8; padding: 8px; white-space: pre-wrap; word-break: break-all; max-height: 400px; overflow-y: auto; }
+#login { padding: 8px; }
+</style>
+</head>
+<body>
+<nav>
+<h2>Tunnels</h2>
+<div id="login">
+<input id="token" type="password" placeholder="Admin token" size="16">
+<button id="save">Save</button>
+</div>
+<ul id="tunnels"></ul>
+</nav>
+<div id="requests"><h2>Requests</h2><ul id="list"></ul></div>
+<div id="details"><p class="muted">Select a request</p></div>
+<script>
+(function () {
+  var token = localStorage.getItem("prxpass-token") || "";
+  var tunnel = "", selected = 0;
+
+  function el(tag, text, cls) {
+    var e = document.createElement(tag);
+    if (text !== undefined) e.textContent = text;
+    if (cls) e.className = cls;
+    return e;
+  }
+
+  function api(path, method) {
+    return fetch(path, {method: method || "GET", headers: {"Authorization": "Bearer " + token}}).then(function (r) {
+      if (r.status === 401) {
+        document.getElementById("login").style.display = "";
+        throw new Error("unauthorized");
+      }
+      return r.json().then(function (body) {
+        if (!r.ok) throw new Error(body.error || r.statusText);
+        return body;
+      });
+    });
+  }
+
+  function body(b64) {
+    if (!b64) return el("p", "No body", "muted");
+    var raw = atob(b64), bytes = new Uint8Array(raw.length);
+    for (var i = 0; i < raw.length; i++) bytes[i] = raw.charCodeAt(i);
+    try {
+      return el("pre", new TextDecoder("utf-8", {fatal: true}).decode(bytes));
+    } catch (e) {
+      return el("p", "Binary body, " + bytes.length + " bytes", "muted");
+    }
+  }
+
+  function headers(h) {
+    var table = el("table");
+    Object.keys(h || {}).sort().forEach(function (name) {
+      h[name].forEach(function (value) {
+        var tr = el("tr");
+        tr.appendChild(el("td", name));
+        tr.appendChild(el("td", value));
+        table.appendChild(tr);
+      });
+    });
+    return table;
+  }
+
+  function showDetails(id) {
+    selected = id;
+    api("/api/requests/" + id).then(function (e) {
+      var d = document.getElementById("details");
+      d.textContent = "";
+      d.appendChild(el("h3", e.method + " " + e.url));
+      d.appendChild(el("p", "Status " + e.status + " in " + (e.duration / 1e6).toFixed(1) + " ms from " +
+        e.remote + " at " + new Date(e.start).toLocaleString() +
+        (e.replay_of ? ", replay of #" + e.replay_of : ""), "muted"));
+      var replay = el("button", "Replay");
+      replay.onclick = function () {
+        replay.disabled = true;
+        api("/api/requests/" + e.id + "/replay", "POST").then(function (res) {
+          replay.disabled = false;
+          replay.textContent = "Replay (last: " + res.status + ")";
+          refreshRequests();
+        }).catch(showError);
+      };
+      d.appendChild(replay);
+      d.appendChild(el("h4", "Request headers"));
+      d.appendChild(headers(e.request_headers));
+      d.appendChild(el("h4", "Request body" + (e.request_truncated ? " (truncated)" : "")));
+      d.appendChild(body(e.request_body));
+      d.appendChild(el("h4", "Response headers"));
+      d.appendChild(headers(e.response_headers));
+      d.appendChild(el("h4", "Response body" + (e.response_truncated ? " (truncated)" : "")));
+      d.appendChild(body(e.response_body));
+      refreshRequests();
+    }).catch(showError);
+  }
+
+  function showError(err) {
+    var d = document.getElementById("details");
+    d.textContent = "";
+    d.appendChild(el("p", err.message, "error"));
+  }
+
+  function refreshTunnels() {
+    if (!token) return;
+    api("/api/tunnels").then(function (tunnels) {
+      document.getElementById("login").style.display = "none";
+      var ul = document.getElementById("tunnels");
+      ul.textContent = "";
+      tunnels.sort(function (a, b) { return a.id < b.id ? -1 : 1; });
+      tunnels.forEach(function (t) {
+        var li = el("li", t.id + " ");
+        li.appendChild(el("span", t.type, "muted"));
+        li.title = t.owner + " " + t.remote;
+        if (t.id === tunnel) li.className = "selected";
+        li.onclick = function () { tunnel = t.id; refreshTunnels(); refreshRequests(); };
+        ul.appendChild(li);
+      });
+    }).catch(function () {});
+  }
+
+  function refreshRequests() {
+    if (!token || !tunnel) return;
+    api("/api/tunnels/" + encodeURIComponent(tunnel) + "/requests").then(function (requests) {
+      var ul = document.getElementById("list");
+      ul.textContent = "";
+      requests.forEach(function (r) {
+        var li = el("li");
+        li.appendChild(el("span", r.status || "-", "status"));
+        li.appendChild(document.createTextNode(r.method + " " + r.url.replace(/^https?:\/\/[^\/]+/, "") + " "));
+        li.appendChild(el("span", (r.duration / 1e6).toFixed(1) + " ms", "muted"));
+        if (r.id === selected) li.className = "selected";
+        li.onclick = function () { showDetails(r.id); };
+        ul.appendChild(li);
+      });
+    }).catch(showError);
+  }
+
+  document.getElementById("token").value = token;
+  document.getElementById("save").onclick = function () {
+    token = document.getElementById("token").value;
+    localStorage.setItem("prxpass-token", token);
+    refreshTunnels();
+  };
+  refreshTunnels();
+  setInterval(function () { refreshTunnels(); refreshRequests(); }, 2000);
+})();
+</script>
+</body>
+</html>
+`
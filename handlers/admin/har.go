@@ -0,0 +1,48 @@
+package admin
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/Defman21/prxpass-server/capture"
+)
+
+// har exports captured exchanges as HAR 1.2. The optional tunnel, since
+// and until (RFC 3339) query parameters narrow them down.
+func (a *API) har(w http.ResponseWriter, r *http.Request) {
+	if a.captures == nil {
+		writeError(w, http.StatusNotFound, "capture is disabled")
+		return
+	}
+	query := r.URL.Query()
+	since, err := parseTime(query.Get("since"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "since: expected an RFC 3339 time")
+		return
+	}
+	until, err := parseTime(query.Get("until"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "until: expected an RFC 3339 time")
+		return
+	}
+	exchanges := []*capture.Exchange{}
+	for _, e := range a.captures.List(query.Get("tunnel")) {
+		if !since.IsZero() && e.Start.Before(since) {
+			continue
+		}
+		if !until.IsZero() && !e.Start.Before(until) {
+			continue
+		}
+		exchanges = append(exchanges, e)
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="prxpass.har"`)
+	writeJSON(w, http.StatusOK, capture.NewHAR(exchanges))
+}
+
+// parseTime parses an RFC 3339 time, empty is the zero time
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
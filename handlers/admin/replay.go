@@ -0,0 +1,142 @@
+package admin
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/Defman21/prxpass-server/capture"
+	"github.com/Defman21/prxpass-server/common"
+)
+
+var (
+	// ErrTruncatedBody the captured body is incomplete and no body was
+	// given to replay instead
+	ErrTruncatedBody = errors.New("captured body is truncated, send a body to replay")
+	// ErrAbsolutePath a replay can only change the path within the tunnel
+	ErrAbsolutePath = errors.New("path must not name a host")
+)
+
+// Edits changes to a replayed request, empty fields keep the captured
+// value
+type Edits struct {
+	Method string `json:"method"`
+	// Path the path and query, relative to the captured URL
+	Path string `json:"path"`
+	// Headers replace the named headers, an empty list removes one
+	Headers map[string][]string `json:"headers"`
+	Body    *string             `json:"body"`
+}
+
+// Replayed the response to a replayed request
+type Replayed struct {
+	Status   int           `json:"status"`
+	Headers  http.Header   `json:"headers"`
+	Body     []byte        `json:"body"`
+	Duration time.Duration `json:"duration"`
+}
+
+// replay sends a captured request through its tunnel again and returns
+// the new response. The replay is captured like any other request.
+func (a *API) replay(w http.ResponseWriter, r *http.Request) {
+	if a.proxy == nil {
+		writeError(w, http.StatusNotFound, "HTTP tunnels are disabled")
+		return
+	}
+	e, ok := a.exchange(w, r)
+	if !ok {
+		return
+	}
+	var edits Edits
+	if err := json.NewDecoder(r.Body).Decode(&edits); err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, "expected {\"method\", \"path\", \"headers\", \"body\"}")
+		return
+	}
+	if _, ok := a.registry.Lookup(e.Tunnel); !ok {
+		writeError(w, http.StatusNotFound, "tunnel not found")
+		return
+	}
+	req, err := replayRequest(e, &edits)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	req.RemoteAddr = r.RemoteAddr
+	req = capture.WithReplayOf(req.WithContext(r.Context()), e.ID)
+
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	a.proxy.ServeHTTP(rec, req)
+	common.Logger.Infow("Admin: Request replayed",
+		"id", e.Tunnel,
+		"request", e.ID,
+		"status", rec.Code,
+		"remote", r.RemoteAddr,
+	)
+	writeJSON(w, http.StatusOK, Replayed{
+		Status:   rec.Code,
+		Headers:  rec.Header(),
+		Body:     rec.Body.Bytes(),
+		Duration: time.Since(start),
+	})
+}
+
+// replayRequest rebuilds a captured request with the edits applied
+func replayRequest(e *capture.Exchange, edits *Edits) (*http.Request, error) {
+	body := e.RequestBody
+	if edits.Body != nil {
+		body = []byte(*edits.Body)
+	} else if e.RequestTruncated {
+		return nil, ErrTruncatedBody
+	}
+	method := e.Method
+	if edits.Method != "" {
+		method = edits.Method
+	}
+	u, err := url.Parse(e.URL)
+	if err != nil {
+		return nil, err
+	}
+	if edits.Path != "" {
+		ref, err := url.Parse(edits.Path)
+		if err != nil {
+			return nil, err
+		}
+		if ref.Scheme != "" || ref.Host != "" {
+			return nil, ErrAbsolutePath
+		}
+		u = u.ResolveReference(ref)
+	}
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	// shaped like a server request: the router matches an absolute URL on
+	// its host including the port, but a Host header without it
+	req.Host = u.Host
+	req.URL.Scheme = ""
+	req.URL.Host = ""
+	req.RequestURI = u.RequestURI()
+	for name, values := range e.RequestHeaders {
+		req.Header[name] = append([]string(nil), values...)
+	}
+	for name, values := range edits.Headers {
+		if len(values) == 0 {
+			req.Header.Del(name)
+			continue
+		}
+		req.Header[http.CanonicalHeaderKey(name)] = values
+	}
+	// the body may have changed, streamed requests send the header as is
+	req.Header.Del("Content-Length")
+	if len(body) > 0 {
+		req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	return req, nil
+}
@@ -0,0 +1,117 @@
+package http
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/Defman21/prxpass-server/capture"
+	"github.com/Defman21/prxpass-server/types"
+	"github.com/gorilla/mux"
+)
+
+// captureWriter records the headers and the start of the body of a
+// response
+type captureWriter struct {
+	*statusRecorder
+	header http.Header
+	body   *capture.Body
+	proto  string
+}
+
+// protoRecorder a writer that records the protocol of the proxied response
+type protoRecorder interface {
+	recordProto(proto string)
+}
+
+func (w *captureWriter) recordProto(proto string) {
+	w.proto = proto
+}
+
+// recordProto passes the protocol of the client's response to the
+// capture, if the request is captured
+func recordProto(w http.ResponseWriter, proto string) {
+	if rec, ok := w.(protoRecorder); ok {
+		rec.recordProto(proto)
+	}
+}
+
+func (w *captureWriter) WriteHeader(status int) {
+	w.snapshot()
+	w.statusRecorder.WriteHeader(status)
+}
+
+func (w *captureWriter) Write(p []byte) (int, error) {
+	w.snapshot()
+	w.body.Write(p)
+	return w.statusRecorder.Write(p)
+}
+
+// snapshot copies the response headers once they are about to be sent
+func (w *captureWriter) snapshot() {
+	if w.header == nil {
+		w.header = cloneHeader(w.Header())
+	}
+}
+
+func cloneHeader(h http.Header) http.Header {
+	clone := make(http.Header, len(h))
+	for k, v := range h {
+		clone[k] = append([]string(nil), v...)
+	}
+	return clone
+}
+
+// record stores the requests to registered tunnels and their responses
+// in captures, nil disables it
+func record(registry *types.Registry, captures *capture.Buffer, next http.HandlerFunc) http.HandlerFunc {
+	if captures == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["subdomain"]
+		if _, ok := registry.Lookup(id); !ok {
+			next(w, r)
+			return
+		}
+		exchange := &capture.Exchange{
+			Tunnel:         id,
+			Start:          time.Now(),
+			Remote:         r.RemoteAddr,
+			Method:         r.Method,
+			URL:            requestURL(r),
+			Proto:          r.Proto,
+			RequestHeaders: cloneHeader(r.Header),
+			ReplayOf:       capture.ReplayOf(r),
+		}
+		requestBody := captures.NewBody()
+		if r.Body != nil {
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.TeeReader(r.Body, requestBody), r.Body}
+		}
+		rec := &captureWriter{
+			statusRecorder: &statusRecorder{ResponseWriter: w},
+			body:           captures.NewBody(),
+		}
+		next(rec, r)
+		rec.snapshot()
+		exchange.Duration = time.Since(exchange.Start)
+		exchange.Status = rec.status
+		exchange.ResponseProto = rec.proto
+		exchange.ResponseHeaders = rec.header
+		exchange.RequestBody, exchange.RequestTruncated = requestBody.Bytes()
+		exchange.ResponseBody, exchange.ResponseTruncated = rec.body.Bytes()
+		captures.Add(exchange)
+	}
+}
+
+// requestURL the absolute URL the visitor asked for
+func requestURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + r.URL.RequestURI()
+}
@@ -3,54 +3,82 @@ package http
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httputil"
+	"strings"
 
+	"github.com/Defman21/prxpass-server/capture"
 	"github.com/Defman21/prxpass-server/common"
+	"github.com/Defman21/prxpass-server/helpers"
+	"github.com/Defman21/prxpass-server/metrics"
 	"github.com/Defman21/prxpass-server/types"
 	"github.com/gorilla/mux"
 )
 
-// Handle http client handler
-func Handle(clients *types.Clients, useHTTPS bool, serverAddr, host, cert, key string) {
+// ControlPath the WebSocket endpoint of the control protocol on the
+// public host, for clients that can only reach HTTP(S)
+const ControlPath = "/_prxpass/connect"
+
+// NewHandler the router of the public host and its tunnel subdomains.
+// Control connections upgraded at ControlPath are passed to connect with
+// the requested tunnel mode. Proxied exchanges are recorded in captures
+// unless it is nil.
+func NewHandler(registry *types.Registry, host string, maxBodySize int64, captures *capture.Buffer, connect func(con net.Conn, mode string)) http.Handler {
 	r := mux.NewRouter()
-	s := r.Host(fmt.Sprintf("{subdomain:[a-z0-9]+}.%v", host)).Subrouter()
+	r.Host(host).Path(ControlPath).HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mode := r.URL.Query().Get("mode")
+		if mode == "" {
+			mode = types.ModeHTTP
+		}
+		con, err := helpers.UpgradeWebSocket(w, r)
+		if err != nil {
+			common.Logger.Warnw("HTTP: Control upgrade failed",
+				"remote", r.RemoteAddr,
+				"err", err,
+			)
+			return
+		}
+		metrics.ControlConnections.With("websocket").Inc()
+		common.Logger.Infow("Client connected [websocket]",
+			"remote", r.RemoteAddr,
+			"mode", mode,
+		)
+		connect(con, mode)
+	})
+	s := r.Host(fmt.Sprintf("{subdomain:[a-z0-9-]+}.%v", host)).Subrouter()
 
-	s.HandleFunc("/{url:.*}", func(w http.ResponseWriter, r *http.Request) {
+	s.HandleFunc("/{url:.*}", instrument(record(registry, captures, func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
-		if cl, ok := (*clients)[vars["subdomain"]]; ok {
-			dump, _ := httputil.DumpRequest(r, true)
-			go func() {
-				cl.Request <- &types.Request{Type: "http", Data: dump}
-			}()
-			for {
-				select {
-				case respChan := <-cl.Response:
-					if respChan.Type != "http" {
-						common.Logger.Warnw("HTTP: Unsupported response type",
-							"type", respChan.Type,
-						)
-						w.Write([]byte("Unsupported response type"))
-					}
-					reader := bufio.NewReader(bytes.NewReader(respChan.Data))
-					resp, _ := http.ReadResponse(reader, r)
-					defer func() {
-						if err := recover(); err != nil {
-							w.Write([]byte(fmt.Sprintf("Panic!\n%v\n%v", string(dump), string(respChan.Data))))
-							return
-						}
-					}()
-					body, _ := ioutil.ReadAll(resp.Body)
-					for k := range resp.Header {
-						w.Header().Set(k, resp.Header.Get(k))
-					}
-					w.WriteHeader(resp.StatusCode)
-					w.Write(body)
-					return
-				}
+		if tooLarge(r, maxBodySize) {
+			common.Logger.Warnw("HTTP: Request body too large",
+				"id", vars["subdomain"],
+				"size", r.ContentLength,
+			)
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if cl, ok := registry.Lookup(vars["subdomain"]); ok {
+			if isUpgrade(r) && cl.Supports(types.FeatureWebSockets) {
+				serveUpgrade(w, r, cl, vars["subdomain"])
+				return
+			}
+			if isUpgrade(r) {
+				common.Logger.Warnw("HTTP: Upgrade not supported by client",
+					"id", vars["subdomain"],
+				)
+				http.Error(w, "Client does not support upgrades", http.StatusNotImplemented)
+				return
+			}
+			if cl.Supports(types.FeatureStreams) {
+				serveStream(w, r, cl, vars["subdomain"], maxBodySize)
+				return
 			}
+			serveMessage(w, r, cl, vars["subdomain"], maxBodySize)
+			return
 		} else {
 			common.Logger.Warnw("Client not found",
 				"id", vars["subdomain"],
@@ -58,7 +86,12 @@ func Handle(clients *types.Clients, useHTTPS bool, serverAddr, host, cert, key s
 			w.Write([]byte("Client not found"))
 			return
 		}
-	})
+	})))
+	return r
+}
+
+// Handle serves the handler of NewHandler over HTTP or HTTPS
+func Handle(handler http.Handler, useHTTPS bool, serverAddr, host, cert, key string) {
 	if useHTTPS {
 		common.Logger.Infow("Listening [https server]",
 			"https", useHTTPS,
@@ -67,13 +100,265 @@ func Handle(clients *types.Clients, useHTTPS bool, serverAddr, host, cert, key s
 			"cert", cert,
 			"key", key,
 		)
-		http.ListenAndServeTLS(serverAddr, cert, key, r)
+		http.ListenAndServeTLS(serverAddr, cert, key, handler)
 	} else {
 		common.Logger.Infow("Listening [http server]",
 			"https", useHTTPS,
 			"server", serverAddr,
 			"host", host,
 		)
-		http.ListenAndServe(serverAddr, r)
+		http.ListenAndServe(serverAddr, handler)
+	}
+}
+
+// serveStream proxies a request over a multiplexed stream
+func serveStream(w http.ResponseWriter, r *http.Request, cl *types.Client, id string, maxBodySize int64) {
+	stream, err := cl.OpenStream("http")
+	if err != nil {
+		common.Logger.Warnw("HTTP: OpenStream failed",
+			"id", id,
+			"err", err,
+		)
+		http.Error(w, "Client disconnected", http.StatusBadGateway)
+		return
+	}
+	bodyErr := make(chan error, 1)
+	done := make(chan struct{})
+	defer func() {
+		// closing the stream ends a body copy blocked on the stream, and
+		// net/http forbids reading the body once the handler returns
+		stream.Close()
+		<-done
+	}()
+	go func() {
+		defer close(done)
+		err := writeRequest(stream, r, maxBodySize)
+		bodyErr <- err
+		if err != nil {
+			// unblocks the response reader below
+			stream.Reset()
+		}
+	}()
+
+	resp, err := http.ReadResponse(bufio.NewReader(stream), r)
+	if err != nil {
+		select {
+		case werr := <-bodyErr:
+			if werr == errBodyTooLarge {
+				common.Logger.Warnw("HTTP: Request body too large",
+					"id", id,
+					"stream", stream.ID(),
+				)
+				http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+		default:
+		}
+		if err == types.ErrStreamReset {
+			common.Logger.Warnw("HTTP: Client disconnected",
+				"id", id,
+				"stream", stream.ID(),
+			)
+			http.Error(w, "Client disconnected", http.StatusBadGateway)
+			return
+		}
+		common.Logger.Warnw("HTTP: Malformed response",
+			"id", id,
+			"stream", stream.ID(),
+			"err", err,
+		)
+		http.Error(w, "Malformed response", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	if err := writeResponse(w, resp); err != nil {
+		common.Logger.Warnw("HTTP: Response aborted",
+			"id", id,
+			"stream", stream.ID(),
+			"err", err,
+		)
+	}
+}
+
+// isUpgrade reports whether the request asks for a protocol switch
+func isUpgrade(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, value := range r.Header["Connection"] {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// serveUpgrade proxies an upgrade request and, once the client switches
+// protocols, splices the raw connection with the stream
+func serveUpgrade(w http.ResponseWriter, r *http.Request, cl *types.Client, id string) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Upgrades are not supported", http.StatusInternalServerError)
+		return
+	}
+	stream, err := cl.OpenStream("http")
+	if err != nil {
+		common.Logger.Warnw("HTTP: OpenStream failed",
+			"id", id,
+			"err", err,
+		)
+		http.Error(w, "Client disconnected", http.StatusBadGateway)
+		return
+	}
+
+	dump, _ := httputil.DumpRequest(r, false)
+	if _, err := stream.Write(dump); err != nil {
+		stream.Close()
+		http.Error(w, "Client disconnected", http.StatusBadGateway)
+		return
+	}
+
+	streamReader := bufio.NewReader(stream)
+	resp, err := http.ReadResponse(streamReader, r)
+	if err != nil {
+		stream.Close()
+		common.Logger.Warnw("HTTP: Malformed response",
+			"id", id,
+			"stream", stream.ID(),
+			"err", err,
+		)
+		http.Error(w, "Malformed response", http.StatusBadGateway)
+		return
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		// the client refused the upgrade, pass its answer through
+		defer stream.Close()
+		defer resp.Body.Close()
+		writeResponse(w, resp)
+		return
+	}
+
+	con, buffered, err := hijacker.Hijack()
+	if err != nil {
+		stream.Close()
+		common.Logger.Warnw("HTTP: Hijack failed",
+			"id", id,
+			"err", err,
+		)
+		return
+	}
+	fmt.Fprintf(buffered, "HTTP/1.1 %s\r\n", resp.Status)
+	resp.Header.Write(buffered)
+	buffered.WriteString("\r\n")
+	if err := buffered.Flush(); err != nil {
+		con.Close()
+		stream.Close()
+		return
+	}
+	common.Logger.Infow("HTTP: Protocol switched",
+		"id", id,
+		"stream", stream.ID(),
+		"upgrade", resp.Header.Get("Upgrade"),
+	)
+	helpers.Pipe(
+		helpers.WithReader(buffered.Reader, con),
+		helpers.WithReader(streamReader, stream),
+	)
+}
+
+// serveMessage proxies a request as a single http/request RPC. The whole
+// request has to fit in one frame, larger bodies are refused.
+func serveMessage(w http.ResponseWriter, r *http.Request, cl *types.Client, id string, maxBodySize int64) {
+	maxBodySize = messageBodyLimit(r, maxBodySize)
+	if tooLarge(r, maxBodySize) {
+		common.Logger.Warnw("HTTP: Request body too large for a message",
+			"id", id,
+			"size", r.ContentLength,
+		)
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	limitBody(r, maxBodySize)
+	req, err := newRequest(r, cl.Version())
+	if err == errBodyTooLarge {
+		common.Logger.Warnw("HTTP: Request body too large",
+			"id", id,
+		)
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
 	}
+	if err != nil {
+		common.Logger.Warnw("HTTP: Reading request failed",
+			"id", id,
+			"err", err,
+		)
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	streamID, respChan := cl.NewPending()
+	defer cl.RemovePending(streamID)
+	req.ID = streamID
+	go func() {
+		select {
+		case cl.Request <- req:
+		case <-r.Context().Done():
+		}
+	}()
+	select {
+	case resp, ok := <-respChan:
+		if !ok {
+			common.Logger.Warnw("HTTP: Client disconnected",
+				"id", id,
+				"stream", streamID,
+			)
+			http.Error(w, "Client disconnected", http.StatusBadGateway)
+			return
+		}
+		if resp.Type != "http" {
+			common.Logger.Warnw("HTTP: Unsupported response type",
+				"id", id,
+				"type", resp.Type,
+			)
+			http.Error(w, "Unsupported response type", http.StatusBadGateway)
+			return
+		}
+		if cl.Version() >= types.ProtocolVersion2 {
+			if resp.Status == 0 {
+				malformedResponse(w, id, streamID, errors.New("no status"))
+				return
+			}
+			copyHeader(w.Header(), resp.Headers)
+			w.WriteHeader(resp.Status)
+			w.Write(resp.Body)
+			return
+		}
+		httpResp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(resp.Data)), r)
+		if err != nil {
+			malformedResponse(w, id, streamID, err)
+			return
+		}
+		defer httpResp.Body.Close()
+		body, err := ioutil.ReadAll(httpResp.Body)
+		if err != nil {
+			malformedResponse(w, id, streamID, err)
+			return
+		}
+		recordProto(w, httpResp.Proto)
+		copyHeader(w.Header(), httpResp.Header)
+		w.WriteHeader(httpResp.StatusCode)
+		w.Write(body)
+	case <-r.Context().Done():
+	}
+}
+
+// malformedResponse answers 502 for a response the client got wrong
+func malformedResponse(w http.ResponseWriter, id, streamID string, err error) {
+	common.Logger.Warnw("HTTP: Malformed response",
+		"id", id,
+		"stream", streamID,
+		"err", err,
+	)
+	http.Error(w, "Malformed response", http.StatusBadGateway)
 }
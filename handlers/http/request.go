@@ -0,0 +1,125 @@
+package http
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+
+	"github.com/Defman21/prxpass-server/types"
+)
+
+// errBodyTooLarge the request body exceeds the max body size
+var errBodyTooLarge = errors.New("request body too large")
+
+// limitedBody fails once more than remaining bytes are read
+type limitedBody struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	// read at most one byte past the limit to detect overflow
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n - 1, errBodyTooLarge
+	}
+	return n, err
+}
+
+// limitBody caps the request body at maxBodySize, 0 means unlimited
+func limitBody(r *http.Request, maxBodySize int64) {
+	if maxBodySize > 0 && r.Body != nil {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{&limitedBody{r: r.Body, remaining: maxBodySize}, r.Body}
+	}
+}
+
+// messageOverhead room in a frame for the message envelope around the
+// request head and body
+const messageOverhead = 4 << 10
+
+// messageBodyLimit the largest body that still fits a single http/request
+// frame next to the request head, capped at maxBodySize
+func messageBodyLimit(r *http.Request, maxBodySize int64) int64 {
+	head, _ := httputil.DumpRequest(r, false)
+	limit := int64(types.DefaultMaxFrameSize - len(head) - messageOverhead)
+	if maxBodySize > 0 && maxBodySize < limit {
+		return maxBodySize
+	}
+	return limit
+}
+
+// tooLarge reports whether the declared body size exceeds the limit
+func tooLarge(r *http.Request, maxBodySize int64) bool {
+	return maxBodySize > 0 && r.ContentLength > maxBodySize
+}
+
+// writeRequest sends the request head and then streams the body in
+// chunks, re-applying chunked encoding if the visitor used it
+func writeRequest(stream types.StreamConn, r *http.Request, maxBodySize int64) error {
+	head, err := httputil.DumpRequest(r, false)
+	if err != nil {
+		return err
+	}
+	if _, err := stream.Write(head); err != nil {
+		return err
+	}
+	if r.Body != nil {
+		limitBody(r, maxBodySize)
+		chunked := len(r.TransferEncoding) > 0 && r.TransferEncoding[0] == "chunked"
+		var body io.Writer = stream
+		var chunkedWriter io.WriteCloser
+		if chunked {
+			chunkedWriter = httputil.NewChunkedWriter(stream)
+			body = chunkedWriter
+		}
+		if _, err := io.Copy(body, r.Body); err != nil {
+			return err
+		}
+		if chunked {
+			chunkedWriter.Close()
+			// no trailers
+			if _, err := stream.Write([]byte("\r\n")); err != nil {
+				return err
+			}
+		}
+	}
+	return stream.CloseWrite()
+}
+
+// newRequest builds the http/request payload for the client protocol
+// version: a raw dump for version 1, structured fields for version 2
+func newRequest(r *http.Request, version int) (*types.Request, error) {
+	if version < types.ProtocolVersion2 {
+		dump, err := httputil.DumpRequest(r, true)
+		return &types.Request{Type: "http", Data: dump}, err
+	}
+	var body []byte
+	if r.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(r.Body); err != nil {
+			return nil, err
+		}
+	}
+	headers := make(map[string][]string, len(r.Header)+1)
+	for k, v := range r.Header {
+		headers[k] = v
+	}
+	headers["Host"] = []string{r.Host}
+	return &types.Request{
+		Type:    "http",
+		Method:  r.Method,
+		URL:     r.URL.RequestURI(),
+		Proto:   r.Proto,
+		Headers: headers,
+		Body:    body,
+	}, nil
+}
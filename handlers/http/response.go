@@ -0,0 +1,61 @@
+package http
+
+import (
+	"io"
+	"net/http"
+)
+
+// responseChunkSize largest body chunk written before a flush
+const responseChunkSize = 32 << 10
+
+// hopHeaders headers that only apply to a single connection
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+}
+
+// copyHeader copies end-to-end headers of the client response
+func copyHeader(dst, src http.Header) {
+	for k, v := range src {
+		dst[k] = v
+	}
+	for _, k := range hopHeaders {
+		dst.Del(k)
+	}
+}
+
+// writeResponse sends the headers right away and streams the body,
+// flushing every chunk as soon as the client sends it. Reading only as
+// fast as the visitor accepts data applies backpressure to the stream.
+func writeResponse(w http.ResponseWriter, resp *http.Response) error {
+	recordProto(w, resp.Proto)
+	copyHeader(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+	flusher, canFlush := w.(http.Flusher)
+	if canFlush {
+		flusher.Flush()
+	}
+	buf := make([]byte, responseChunkSize)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			if canFlush {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,569 @@
+package ssh
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Defman21/prxpass-server/auth"
+	"github.com/Defman21/prxpass-server/common"
+	"github.com/Defman21/prxpass-server/helpers"
+	"github.com/Defman21/prxpass-server/metrics"
+	"github.com/Defman21/prxpass-server/types"
+	cryptossh "golang.org/x/crypto/ssh"
+)
+
+// hostKeyBits size of a generated RSA host key
+const hostKeyBits = 2048
+
+var (
+	// ErrNotPermitted the identity may not open this tunnel
+	ErrNotPermitted = errors.New("tunnel not permitted")
+	// ErrModeDisabled the tunnel mode is not enabled on the server
+	ErrModeDisabled = errors.New("tunnel mode not enabled")
+	// errKeepaliveTimeout the client did not answer a keepalive
+	errKeepaliveTimeout = errors.New("keepalive timeout")
+)
+
+// Server an SSH front end, `ssh -R 80:localhost:3000 tunnel@host` opens
+// an HTTP tunnel and other remote ports open TCP tunnels
+type Server struct {
+	config    *types.Config
+	registry  *types.Registry
+	ids       helpers.IDGenerator
+	modes     map[string]bool
+	keys      *auth.AuthorizedKeys
+	sshConfig *cryptossh.ServerConfig
+}
+
+// NewServer creates an SSH front end, forwards only open tunnels of the
+// enabled modes
+func NewServer(config *types.Config, registry *types.Registry, ids helpers.IDGenerator, modes map[string]bool) (*Server, error) {
+	if config.SSH.AuthorizedKeys == "" {
+		return nil, errors.New("ssh.authorized_keys is not configured")
+	}
+	signer, err := loadHostKey(config.SSH.HostKey)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		config:   config,
+		registry: registry,
+		ids:      ids,
+		modes:    modes,
+		keys:     auth.NewAuthorizedKeys(config.SSH.AuthorizedKeys),
+	}
+	s.sshConfig = &cryptossh.ServerConfig{PublicKeyCallback: s.publicKey}
+	s.sshConfig.AddHostKey(signer)
+	return s, nil
+}
+
+// loadHostKey reads the host key, generating one when the file is missing
+func loadHostKey(path string) (cryptossh.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		key, err := rsa.GenerateKey(rand.Reader, hostKeyBits)
+		if err != nil {
+			return nil, err
+		}
+		data = pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(key),
+		})
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			return nil, err
+		}
+		common.Logger.Infow("SSH: Generated host key",
+			"path", path,
+		)
+	} else if err != nil {
+		return nil, err
+	}
+	return cryptossh.ParsePrivateKey(data)
+}
+
+// publicKey authenticates a login against the authorized keys, the
+// accepted key is kept for looking up the identity after the handshake
+func (s *Server) publicKey(meta cryptossh.ConnMetadata, key cryptossh.PublicKey) (*cryptossh.Permissions, error) {
+	if _, err := s.keys.Authenticate(key); err != nil {
+		metrics.AuthFailures.With("ssh").Inc()
+		common.Logger.Warnw("SSH: Authentication failed",
+			"remote", meta.RemoteAddr().String(),
+			"fingerprint", cryptossh.FingerprintSHA256(key),
+		)
+		return nil, err
+	}
+	return &cryptossh.Permissions{
+		Extensions: map[string]string{"key": string(key.Marshal())},
+	}, nil
+}
+
+// identity the identity of the key a connection authenticated with
+func (s *Server) identity(sshCon *cryptossh.ServerConn) (*auth.Identity, error) {
+	key, err := cryptossh.ParsePublicKey([]byte(sshCon.Permissions.Extensions["key"]))
+	if err != nil {
+		return nil, err
+	}
+	return s.keys.Authenticate(key)
+}
+
+// ListenAndServe accepts SSH connections
+func (s *Server) ListenAndServe() error {
+	ln, err := net.Listen("tcp", s.config.SSH.Server)
+	if err != nil {
+		return err
+	}
+	common.Logger.Infow("Listening [ssh]",
+		"address", s.config.SSH.Server,
+	)
+	for {
+		con, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serve(con)
+	}
+}
+
+// serve runs the SSH handshake and the requests of a connection
+func (s *Server) serve(con net.Conn) {
+	// an idle peer must not hold the connection before authenticating
+	con.SetDeadline(time.Now().Add(types.HandshakeTimeout))
+	sshCon, chans, reqs, err := cryptossh.NewServerConn(con, s.sshConfig)
+	con.SetDeadline(time.Time{})
+	if err != nil {
+		common.Logger.Warnw("SSH: Handshake failed",
+			"remote", con.RemoteAddr().String(),
+			"err", err,
+		)
+		con.Close()
+		return
+	}
+	identity, err := s.identity(sshCon)
+	if err != nil {
+		sshCon.Close()
+		return
+	}
+	c := &conn{
+		server:   s,
+		ssh:      sshCon,
+		net:      con,
+		identity: identity,
+		tunnels:  make(map[string]*tunnel),
+		done:     make(chan struct{}),
+	}
+	metrics.ControlConnections.With("ssh").Inc()
+	common.Logger.Infow("Client connected [ssh]",
+		"remote", con.RemoteAddr().String(),
+		"user", c.identity.Name,
+	)
+	go c.channels(chans)
+	go c.keepalive()
+	for req := range reqs {
+		c.request(req)
+	}
+	close(c.done)
+	c.closeTunnels()
+	common.Logger.Infow("SSH: Client disconnected",
+		"remote", con.RemoteAddr().String(),
+		"user", c.identity.Name,
+	)
+}
+
+// keepalive sends keepalive@openssh.com every heartbeat interval and
+// closes the connection, and with it the tunnels, when the client does
+// not answer within the heartbeat timeout
+func (c *conn) keepalive() {
+	interval, timeout := types.HeartbeatDurations(&c.server.config.HTTP)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.done:
+			return
+		}
+		replied := make(chan error, 1)
+		go func() {
+			// any reply counts, clients answer unknown requests with false
+			_, _, err := c.ssh.SendRequest("keepalive@openssh.com", true, nil)
+			replied <- err
+		}()
+		var err error
+		select {
+		case err = <-replied:
+		case <-time.After(timeout):
+			err = errKeepaliveTimeout
+		case <-c.done:
+			return
+		}
+		if err != nil {
+			common.Logger.Warnw("SSH: Client evicted",
+				"remote", c.net.RemoteAddr().String(),
+				"user", c.identity.Name,
+				"reason", err,
+			)
+			c.ssh.Close()
+			return
+		}
+	}
+}
+
+// forwardRequest the payload of tcpip-forward and cancel-tcpip-forward
+type forwardRequest struct {
+	Addr string
+	Port uint32
+}
+
+// forwardReply the answer to a tcpip-forward for port 0
+type forwardReply struct {
+	Port uint32
+}
+
+// forwardedChannel the payload of a forwarded-tcpip channel
+type forwardedChannel struct {
+	Addr       string
+	Port       uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+// tunnel a remote forward registered as a tunnel
+type tunnel struct {
+	id     string
+	client *types.Client
+	con    *tunnelConn
+}
+
+// conn an SSH connection, it may hold several tunnels
+type conn struct {
+	server   *Server
+	ssh      *cryptossh.ServerConn
+	net      net.Conn
+	identity *auth.Identity
+	tunnels  map[string]*tunnel
+	session  cryptossh.Channel
+	output   []string
+	mu       sync.Mutex
+	// done closed once the connection is gone
+	done chan struct{}
+}
+
+// request handles a global request
+func (c *conn) request(req *cryptossh.Request) {
+	switch req.Type {
+	case "tcpip-forward":
+		var fwd forwardRequest
+		if err := cryptossh.Unmarshal(req.Payload, &fwd); err != nil {
+			req.Reply(false, nil)
+			return
+		}
+		port, err := c.forward(fwd)
+		if err != nil {
+			common.Logger.Warnw("SSH: Forward rejected",
+				"user", c.identity.Name,
+				"addr", fwd.Addr,
+				"port", fwd.Port,
+				"err", err,
+			)
+			c.print(fmt.Sprintf("Forward of %s:%d rejected: %v", fwd.Addr, fwd.Port, err))
+			req.Reply(false, nil)
+			return
+		}
+		var payload []byte
+		if fwd.Port == 0 {
+			payload = cryptossh.Marshal(&forwardReply{Port: port})
+		}
+		req.Reply(true, payload)
+	case "cancel-tcpip-forward":
+		var fwd forwardRequest
+		if err := cryptossh.Unmarshal(req.Payload, &fwd); err != nil {
+			req.Reply(false, nil)
+			return
+		}
+		c.mu.Lock()
+		t, ok := c.tunnels[forwardKey(fwd)]
+		c.mu.Unlock()
+		if ok {
+			t.con.Close()
+		}
+		req.Reply(ok, nil)
+	default:
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// forwardKey identifies a forward within a connection
+func forwardKey(fwd forwardRequest) string {
+	return net.JoinHostPort(fwd.Addr, strconv.Itoa(int(fwd.Port)))
+}
+
+// isWildcard reports whether a bind address names no subdomain
+func isWildcard(addr string) bool {
+	switch addr {
+	case "", "localhost", "0.0.0.0", "127.0.0.1", "::", "*":
+		return true
+	}
+	return false
+}
+
+// forward registers a remote forward as a tunnel. Ports 80 and 443 open
+// an HTTP tunnel, a bind address other than a wildcard requests it as
+// the subdomain. Other ports open a TCP tunnel.
+func (c *conn) forward(fwd forwardRequest) (uint32, error) {
+	s := c.server
+	mode := types.ModeTCP
+	if fwd.Port == 80 || fwd.Port == 443 {
+		mode = types.ModeHTTP
+	}
+	if !s.modes[mode] {
+		return 0, ErrModeDisabled
+	}
+	if !c.identity.Permissions.AllowsType(mode) {
+		return 0, ErrNotPermitted
+	}
+	c.mu.Lock()
+	_, exists := c.tunnels[forwardKey(fwd)]
+	c.mu.Unlock()
+	if exists {
+		return 0, types.ErrIDInUse
+	}
+
+	var id string
+	var err error
+	if mode == types.ModeHTTP && !isWildcard(fwd.Addr) && s.config.HTTP.CustomIDs {
+		id = fwd.Addr
+		err = s.registry.Claim(id, c.identity, "")
+	} else {
+		id, err = s.registry.Allocate(s.ids)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if !c.identity.Permissions.AllowsSubdomain(id) {
+		s.registry.Release(id)
+		return 0, ErrNotPermitted
+	}
+
+	t := &tunnel{
+		id:  id,
+		con: &tunnelConn{Conn: c.net, closed: make(chan struct{})},
+	}
+	op := &opener{conn: c, fwd: fwd}
+	t.client = types.NewStreamClient(t.con, mode, c.identity, op)
+	port := fwd.Port
+	address := s.config.HTTPAddress(id)
+	if mode == types.ModeTCP {
+		params := map[string]string{}
+		if fwd.Port != 0 {
+			params["port"] = strconv.Itoa(int(fwd.Port))
+		}
+		address, err = t.client.Listen(id, params)
+		if err != nil {
+			t.client.Disconnected(s.registry, id)
+			return 0, err
+		}
+		if _, p, err := net.SplitHostPort(address); err == nil {
+			n, _ := strconv.Atoi(p)
+			port = uint32(n)
+		}
+	}
+	// the client cancels and gets channels for the assigned port, not
+	// the port 0 it asked for
+	fwd.Port = port
+	op.fwd = fwd
+	key := forwardKey(fwd)
+	c.mu.Lock()
+	_, exists = c.tunnels[key]
+	c.mu.Unlock()
+	if exists {
+		t.client.Disconnected(s.registry, id)
+		return 0, types.ErrIDInUse
+	}
+	if err := s.registry.Register(id, t.client); err != nil {
+		t.client.Disconnected(s.registry, id)
+		return 0, err
+	}
+
+	c.mu.Lock()
+	c.tunnels[key] = t
+	c.mu.Unlock()
+	go func() {
+		<-t.con.closed
+		c.mu.Lock()
+		delete(c.tunnels, key)
+		c.mu.Unlock()
+		t.client.Disconnected(s.registry, id)
+		c.print(fmt.Sprintf("Tunnel %s closed", address))
+	}()
+	common.Logger.Infow("Registered a client",
+		"id", id,
+		"mode", mode,
+		"address", address,
+		"user", c.identity.Name,
+		"transport", "ssh",
+	)
+	c.print(fmt.Sprintf("Forwarding %s", address))
+	return port, nil
+}
+
+// closeTunnels closes every tunnel of the connection
+func (c *conn) closeTunnels() {
+	c.mu.Lock()
+	tunnels := make([]*tunnel, 0, len(c.tunnels))
+	for _, t := range c.tunnels {
+		tunnels = append(tunnels, t)
+	}
+	c.mu.Unlock()
+	for _, t := range tunnels {
+		t.con.Close()
+	}
+}
+
+// channels accepts the session channel, other channels are rejected
+func (c *conn) channels(chans <-chan cryptossh.NewChannel) {
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(cryptossh.UnknownChannelType, "only session channels are supported")
+			continue
+		}
+		ch, reqs, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		go c.serveSession(ch, reqs)
+	}
+}
+
+// serveSession prints the tunnel addresses to the session, Ctrl-C or
+// Ctrl-D ends the connection
+func (c *conn) serveSession(ch cryptossh.Channel, reqs <-chan *cryptossh.Request) {
+	go func() {
+		for req := range reqs {
+			switch req.Type {
+			case "shell", "pty-req", "exec", "env", "window-change":
+				req.Reply(true, nil)
+			default:
+				req.Reply(false, nil)
+			}
+		}
+	}()
+	c.mu.Lock()
+	c.session = ch
+	for _, line := range c.output {
+		fmt.Fprintf(ch, "%s\r\n", line)
+	}
+	c.output = nil
+	c.mu.Unlock()
+
+	buf := make([]byte, 256)
+	for {
+		n, err := ch.Read(buf)
+		if err != nil {
+			break
+		}
+		for _, b := range buf[:n] {
+			if b == 0x03 || b == 0x04 {
+				c.ssh.Close()
+				return
+			}
+		}
+	}
+	c.mu.Lock()
+	c.session = nil
+	c.mu.Unlock()
+}
+
+// print writes a line to the session, lines printed before the session
+// opens are queued
+func (c *conn) print(line string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.session == nil {
+		c.output = append(c.output, line)
+		return
+	}
+	fmt.Fprintf(c.session, "%s\r\n", line)
+}
+
+// tunnelConn the connection of a single tunnel. Closing it closes the
+// tunnel, the SSH connection stays up for its other tunnels.
+type tunnelConn struct {
+	net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+// Close closes the tunnel
+func (c *tunnelConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
+
+// opener opens forwarded-tcpip channels for the streams of a tunnel
+type opener struct {
+	conn   *conn
+	fwd    forwardRequest
+	lastID uint64
+}
+
+// OpenStream opens a channel to the forward, the first argument is the
+// remote address of the connection being relayed
+func (o *opener) OpenStream(kind string, args ...string) (types.StreamConn, error) {
+	payload := forwardedChannel{
+		Addr:       o.fwd.Addr,
+		Port:       o.fwd.Port,
+		OriginAddr: "127.0.0.1",
+	}
+	if len(args) > 0 {
+		if host, port, err := net.SplitHostPort(args[0]); err == nil {
+			n, _ := strconv.Atoi(port)
+			payload.OriginAddr = host
+			payload.OriginPort = uint32(n)
+		}
+	}
+	ch, reqs, err := o.conn.ssh.OpenChannel("forwarded-tcpip", cryptossh.Marshal(&payload))
+	if err != nil {
+		return nil, err
+	}
+	go cryptossh.DiscardRequests(reqs)
+	return &channelStream{
+		Channel: ch,
+		id:      strconv.FormatUint(atomic.AddUint64(&o.lastID, 1), 10),
+	}, nil
+}
+
+// Notice prints a notice to the session
+func (o *opener) Notice(text string) {
+	o.conn.print(text)
+}
+
+// channelStream an SSH channel as a tunnel stream
+type channelStream struct {
+	cryptossh.Channel
+	id string
+}
+
+// ID the stream ID
+func (s *channelStream) ID() string {
+	return s.id
+}
+
+// Reset aborts the channel
+func (s *channelStream) Reset() error {
+	return s.Channel.Close()
+}
@@ -0,0 +1,97 @@
+package tcp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/Defman21/prxpass-server/common"
+	"github.com/Defman21/prxpass-server/helpers"
+	"github.com/Defman21/prxpass-server/types"
+)
+
+// ErrUnsupported the client did not enable TCP tunnels
+var ErrUnsupported = errors.New("client does not support TCP tunnels")
+
+// Handler exposes clients as raw TCP ports
+type Handler struct {
+	bind  string
+	host  string
+	ports *helpers.PortPool
+}
+
+// NewHandler creates a TCP tunnel handler
+func NewHandler(config *types.TCPConfig) (*Handler, error) {
+	ports, err := helpers.NewPortPool(config.PortMin, config.PortMax)
+	if err != nil {
+		return nil, fmt.Errorf("tcp: %v", err)
+	}
+	return &Handler{
+		bind:  config.Server,
+		host:  config.Host,
+		ports: ports,
+	}, nil
+}
+
+// Listen allocates a port, the port parameter may request a specific one
+func (h *Handler) Listen(c *types.Client, id string, params map[string]string) (string, error) {
+	if !c.Supports(types.FeatureTCP) {
+		return "", ErrUnsupported
+	}
+	requested := 0
+	if params["port"] != "" {
+		port, err := strconv.Atoi(params["port"])
+		if err != nil {
+			return "", err
+		}
+		requested = port
+	}
+	var ln net.Listener
+	port, err := h.ports.Allocate(requested, func(port int) error {
+		var err error
+		ln, err = net.Listen("tcp", fmt.Sprintf("%s:%d", h.bind, port))
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	c.OnClose(func() {
+		ln.Close()
+		h.ports.Release(port)
+	})
+	go h.serve(ln, c, id)
+	common.Logger.Infow("Listening [tcp tunnel]",
+		"id", id,
+		"port", port,
+	)
+	return fmt.Sprintf("%s:%d", h.host, port), nil
+}
+
+// serve relays accepted connections over streams until the listener closes
+func (h *Handler) serve(ln net.Listener, c *types.Client, id string) {
+	for {
+		con, err := ln.Accept()
+		if err != nil {
+			common.Logger.Infow("TCP tunnel closed",
+				"id", id,
+				"reason", err,
+			)
+			return
+		}
+		common.Logger.Infow("TCP: Connection accepted",
+			"id", id,
+			"remote", con.RemoteAddr().String(),
+		)
+		stream, err := c.OpenStream(types.ModeTCP, con.RemoteAddr().String())
+		if err != nil {
+			common.Logger.Warnw("TCP: OpenStream failed",
+				"id", id,
+				"err", err,
+			)
+			con.Close()
+			continue
+		}
+		go helpers.Pipe(con, stream)
+	}
+}
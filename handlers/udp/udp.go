@@ -0,0 +1,215 @@
+package udp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Defman21/prxpass-server/common"
+	"github.com/Defman21/prxpass-server/helpers"
+	"github.com/Defman21/prxpass-server/types"
+)
+
+const (
+	// DefaultIdleTimeout how long a session lives without traffic
+	DefaultIdleTimeout = 60 * time.Second
+	// MaxSessions sessions tracked per tunnel
+	MaxSessions = 1024
+	// maxDatagramSize largest UDP payload
+	maxDatagramSize = 65535
+)
+
+// ErrUnsupported the client did not enable UDP tunnels
+var ErrUnsupported = errors.New("client does not support UDP tunnels")
+
+// Handler exposes clients as UDP ports
+type Handler struct {
+	bind        string
+	host        string
+	idleTimeout time.Duration
+	ports       *helpers.PortPool
+}
+
+// NewHandler creates a UDP tunnel handler
+func NewHandler(config *types.UDPConfig) (*Handler, error) {
+	idleTimeout := DefaultIdleTimeout
+	if config.IdleTimeout > 0 {
+		idleTimeout = time.Duration(config.IdleTimeout) * time.Second
+	}
+	ports, err := helpers.NewPortPool(config.PortMin, config.PortMax)
+	if err != nil {
+		return nil, fmt.Errorf("udp: %v", err)
+	}
+	return &Handler{
+		bind:        config.Server,
+		host:        config.Host,
+		idleTimeout: idleTimeout,
+		ports:       ports,
+	}, nil
+}
+
+// Listen allocates a port, the port parameter may request a specific one
+func (h *Handler) Listen(c *types.Client, id string, params map[string]string) (string, error) {
+	if !c.Supports(types.FeatureUDP) {
+		return "", ErrUnsupported
+	}
+	requested := 0
+	if params["port"] != "" {
+		port, err := strconv.Atoi(params["port"])
+		if err != nil {
+			return "", err
+		}
+		requested = port
+	}
+	var con *net.UDPConn
+	port, err := h.ports.Allocate(requested, func(port int) error {
+		addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", h.bind, port))
+		if err != nil {
+			return err
+		}
+		con, err = net.ListenUDP("udp", addr)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	t := &tunnel{
+		id:          id,
+		client:      c,
+		con:         con,
+		idleTimeout: h.idleTimeout,
+		sessions:    make(map[string]*session),
+		done:        make(chan struct{}),
+	}
+	c.HandleRPC("udp/datagram", t.reply)
+	c.OnClose(func() {
+		close(t.done)
+		con.Close()
+		h.ports.Release(port)
+	})
+	go t.serve()
+	go t.expire()
+	common.Logger.Infow("Listening [udp tunnel]",
+		"id", id,
+		"port", port,
+	)
+	return fmt.Sprintf("%s:%d", h.host, port), nil
+}
+
+// session a remote peer that recently sent a datagram to the tunnel
+type session struct {
+	addr     *net.UDPAddr
+	lastSeen time.Time
+}
+
+// tunnel a UDP port exposed for a client
+type tunnel struct {
+	id          string
+	client      *types.Client
+	con         *net.UDPConn
+	idleTimeout time.Duration
+	sessions    map[string]*session
+	mu          sync.Mutex
+	done        chan struct{}
+}
+
+// serve forwards datagrams from remote peers to the client
+func (t *tunnel) serve() {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := t.con.ReadFromUDP(buf)
+		if err != nil {
+			common.Logger.Infow("UDP tunnel closed",
+				"id", t.id,
+				"reason", err,
+			)
+			return
+		}
+		if !t.touch(addr) {
+			common.Logger.Warnw("UDP: Session limit reached",
+				"id", t.id,
+				"remote", addr.String(),
+			)
+			continue
+		}
+		err = t.client.Send(t.client.NewRPC("udp/datagram", "", buf[:n], addr.String()))
+		if err != nil {
+			common.Logger.Warnw("Send error",
+				"id", t.id,
+				"err", err,
+			)
+		}
+	}
+}
+
+// reply sends a datagram from the client back to a remote peer
+func (t *tunnel) reply(msg *types.Message) {
+	data, args, ok := msg.Payload(msg.Args)
+	if !ok || len(args) < 1 {
+		common.Logger.Warnw("Malformed datagram",
+			"id", t.id,
+		)
+		return
+	}
+	remote := args[0]
+	t.mu.Lock()
+	s, ok := t.sessions[remote]
+	if ok {
+		s.lastSeen = time.Now()
+	}
+	t.mu.Unlock()
+	if !ok {
+		common.Logger.Warnw("UDP: Reply to unknown session",
+			"id", t.id,
+			"remote", remote,
+		)
+		return
+	}
+	if _, err := t.con.WriteToUDP(data, s.addr); err != nil {
+		common.Logger.Warnw("UDP: Write failed",
+			"id", t.id,
+			"remote", remote,
+			"err", err,
+		)
+	}
+}
+
+// touch creates or refreshes the session of a remote peer
+func (t *tunnel) touch(addr *net.UDPAddr) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := addr.String()
+	if s, ok := t.sessions[key]; ok {
+		s.lastSeen = time.Now()
+		return true
+	}
+	if len(t.sessions) >= MaxSessions {
+		return false
+	}
+	t.sessions[key] = &session{addr: addr, lastSeen: time.Now()}
+	return true
+}
+
+// expire drops sessions idle for longer than the idle timeout
+func (t *tunnel) expire() {
+	ticker := time.NewTicker(t.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			t.mu.Lock()
+			for key, s := range t.sessions {
+				if now.Sub(s.lastSeen) > t.idleTimeout {
+					delete(t.sessions, key)
+				}
+			}
+			t.mu.Unlock()
+		case <-t.done:
+			return
+		}
+	}
+}
@@ -1,18 +1,125 @@
 package helpers
 
 import (
-	"math/rand"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
 )
 
+const (
+	// DefaultIDLength length of random IDs
+	DefaultIDLength = 20
+	// DefaultIDAlphabet characters of random IDs
+	DefaultIDAlphabet = "abcdefghijklmnopqrstuvwxyz1234567890"
+	// maxLabelLength longest DNS label
+	maxLabelLength = 63
+)
+
+// ErrInvalidIDConfig the ID generator settings would produce invalid subdomains
+var ErrInvalidIDConfig = errors.New("invalid id generator config")
+
+// IDGenerator generates tunnel IDs
+type IDGenerator interface {
+	ID() (string, error)
+}
+
+// NewIDGenerator creates a generator for a strategy, "random" or "human"
+func NewIDGenerator(strategy string, length int, alphabet string) (IDGenerator, error) {
+	switch strategy {
+	case "", "random":
+		if length == 0 {
+			length = DefaultIDLength
+		}
+		if alphabet == "" {
+			alphabet = DefaultIDAlphabet
+		}
+		if length < 1 || length > maxLabelLength {
+			return nil, fmt.Errorf("%v: length %d", ErrInvalidIDConfig, length)
+		}
+		for _, r := range alphabet {
+			if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9') {
+				return nil, fmt.Errorf("%v: alphabet character %q", ErrInvalidIDConfig, r)
+			}
+		}
+		return &RandomIDs{Length: length, Alphabet: alphabet}, nil
+	case "human":
+		return HumanIDs{}, nil
+	}
+	return nil, fmt.Errorf("%v: strategy %q", ErrInvalidIDConfig, strategy)
+}
+
+// randomInt a uniform random number in [0, n) from crypto/rand
+func randomInt(n int) (int, error) {
+	v, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		return 0, err
+	}
+	return int(v.Int64()), nil
+}
+
+// RandomIDs random IDs over an alphabet
+type RandomIDs struct {
+	Length   int
+	Alphabet string
+}
+
 // ID generate an ID
-func ID() string {
-	letter := []rune("abcdefghijklmnopqrstuvwxyz1234567890")
+func (g *RandomIDs) ID() (string, error) {
+	letter := []rune(g.Alphabet)
 
-	b := make([]rune, 20)
+	b := make([]rune, g.Length)
 
 	for i := range b {
-		b[i] = letter[rand.Intn(len(letter))]
+		n, err := randomInt(len(letter))
+		if err != nil {
+			return "", err
+		}
+		b[i] = letter[n]
 	}
 
-	return string(b)
+	return string(b), nil
+}
+
+var adjectives = []string{
+	"able", "bold", "brave", "bright", "calm", "clever", "cool", "crisp",
+	"eager", "early", "fair", "fancy", "fast", "fine", "fresh", "gentle",
+	"glad", "golden", "grand", "happy", "hidden", "honest", "jolly", "keen",
+	"kind", "lively", "lucky", "mellow", "merry", "mighty", "modern", "neat",
+	"nimble", "noble", "odd", "plain", "polite", "proud", "quick", "quiet",
+	"rapid", "rare", "ready", "royal", "rustic", "shiny", "silent", "silver",
+	"simple", "sleek", "smart", "solid", "sunny", "swift", "tidy", "tiny",
+	"vast", "vivid", "warm", "wild", "wise", "witty", "young", "zesty",
+}
+
+var nouns = []string{
+	"badger", "bear", "beaver", "bison", "canyon", "cedar", "cloud", "comet",
+	"coral", "crane", "delta", "dune", "eagle", "falcon", "fern", "finch",
+	"fjord", "forest", "fox", "galaxy", "glacier", "harbor", "hawk", "heron",
+	"island", "lagoon", "lake", "lark", "lynx", "maple", "meadow", "meteor",
+	"moose", "moth", "nebula", "oak", "ocean", "orca", "otter", "owl",
+	"panda", "pine", "planet", "prairie", "quartz", "raven", "reef", "river",
+	"robin", "salmon", "seal", "sparrow", "spruce", "star", "stream", "swan",
+	"tiger", "trout", "tundra", "valley", "walrus", "willow", "wolf", "zebra",
+}
+
+// HumanIDs readable adjective-noun-number IDs that are valid DNS labels
+type HumanIDs struct{}
+
+// ID generate an ID
+func (HumanIDs) ID() (string, error) {
+	a, err := randomInt(len(adjectives))
+	if err != nil {
+		return "", err
+	}
+	n, err := randomInt(len(nouns))
+	if err != nil {
+		return "", err
+	}
+	num, err := randomInt(10000)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join([]string{adjectives[a], nouns[n], fmt.Sprint(num)}, "-"), nil
 }
@@ -0,0 +1,57 @@
+package helpers
+
+import (
+	"io"
+)
+
+// closeWriter a connection that can be half-closed
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// Pipe copies data between a and b in both directions until both sides
+// are done, then closes them
+func Pipe(a, b io.ReadWriteCloser) {
+	done := make(chan struct{}, 2)
+	halfCopy := func(dst, src io.ReadWriteCloser) {
+		_, err := io.Copy(dst, src)
+		if cw, ok := dst.(closeWriter); ok && err == nil {
+			cw.CloseWrite()
+		} else {
+			// an aborted side tears down both directions
+			a.Close()
+			b.Close()
+		}
+		done <- struct{}{}
+	}
+	go halfCopy(a, b)
+	go halfCopy(b, a)
+	<-done
+	<-done
+	a.Close()
+	b.Close()
+}
+
+// bufferedConn reads through r, which may hold data already read from
+// the underlying connection
+type bufferedConn struct {
+	r io.Reader
+	io.ReadWriteCloser
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.r.Read(p)
+}
+
+// CloseWrite half-closes the underlying connection if it supports it
+func (b *bufferedConn) CloseWrite() error {
+	if cw, ok := b.ReadWriteCloser.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return b.Close()
+}
+
+// WithReader returns rwc reading through r instead
+func WithReader(r io.Reader, rwc io.ReadWriteCloser) io.ReadWriteCloser {
+	return &bufferedConn{r: r, ReadWriteCloser: rwc}
+}
@@ -0,0 +1,85 @@
+package helpers
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+)
+
+var (
+	// ErrNoFreePorts every port of the range is taken
+	ErrNoFreePorts = errors.New("no free ports")
+	// ErrPortOutOfRange the requested port is outside the configured range
+	ErrPortOutOfRange = errors.New("requested port is out of range")
+	// ErrPortInUse the requested port is taken
+	ErrPortInUse = errors.New("requested port is in use")
+	// ErrInvalidPortRange port_min and port_max are unset or not a range
+	// of ports
+	ErrInvalidPortRange = errors.New("invalid port range, set port_min and port_max")
+)
+
+// PortPool hands out ports of a range
+type PortPool struct {
+	min  int
+	max  int
+	used map[int]bool
+	mu   sync.Mutex
+}
+
+// NewPortPool creates a pool of ports in [min, max]
+func NewPortPool(min, max int) (*PortPool, error) {
+	if min < 1 || max > 65535 || min > max {
+		return nil, ErrInvalidPortRange
+	}
+	return &PortPool{
+		min:  min,
+		max:  max,
+		used: make(map[int]bool),
+	}, nil
+}
+
+// Allocate reserves the requested port, or a free one if requested is 0.
+// bind is called with the pool locked and reports whether the port
+// could actually be bound.
+func (p *PortPool) Allocate(requested int, bind func(port int) error) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if requested != 0 {
+		if requested < p.min || requested > p.max {
+			return 0, ErrPortOutOfRange
+		}
+		if p.used[requested] {
+			return 0, ErrPortInUse
+		}
+		if err := bind(requested); err != nil {
+			return 0, err
+		}
+		p.used[requested] = true
+		return requested, nil
+	}
+	size := p.max - p.min + 1
+	if size <= 0 {
+		return 0, ErrNoFreePorts
+	}
+	start := rand.Intn(size)
+	for i := 0; i < size; i++ {
+		port := p.min + (start+i)%size
+		if p.used[port] {
+			continue
+		}
+		if err := bind(port); err != nil {
+			// taken by another process
+			continue
+		}
+		p.used[port] = true
+		return port, nil
+	}
+	return 0, ErrNoFreePorts
+}
+
+// Release returns a port to the pool
+func (p *PortPool) Release(port int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.used, port)
+}
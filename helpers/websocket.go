@@ -0,0 +1,243 @@
+package helpers
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// websocketGUID the RFC 6455 handshake key suffix
+	websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	// closeTimeout how long Close waits to send the close frame
+	closeTimeout = time.Second
+)
+
+// WebSocket opcodes
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+var (
+	// ErrNotWebSocket the request is not a WebSocket handshake
+	ErrNotWebSocket = errors.New("not a websocket handshake")
+	// ErrWebSocketProtocol the peer violated RFC 6455
+	ErrWebSocketProtocol = errors.New("websocket protocol error")
+)
+
+// headerContains reports whether a comma-separated header has the token
+func headerContains(h http.Header, name, token string) bool {
+	for _, value := range h[name] {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// UpgradeWebSocket completes the server side of a WebSocket handshake and
+// returns the connection as a byte stream: reads return the payload of
+// the data frames, writes are sent as binary frames
+func UpgradeWebSocket(w http.ResponseWriter, r *http.Request) (net.Conn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || key == "" ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "Expected a WebSocket handshake", http.StatusBadRequest)
+		return nil, ErrNotWebSocket
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, ErrNotWebSocket
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		return nil, errors.New("response does not support hijacking")
+	}
+	con, brw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	accept := base64.StdEncoding.EncodeToString(sum[:])
+	_, err = fmt.Fprintf(con, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n\r\n", accept)
+	if err != nil {
+		con.Close()
+		return nil, err
+	}
+	return &wsConn{Conn: con, r: brw.Reader}, nil
+}
+
+// wsConn a WebSocket connection as a net.Conn
+type wsConn struct {
+	net.Conn
+	r         *bufio.Reader
+	remaining uint64
+	mask      [4]byte
+	masked    bool
+	offset    int
+	readMu    sync.Mutex
+	writeMu   sync.Mutex
+	closeOnce sync.Once
+}
+
+// Read reads the payload of data frames, control frames are handled on
+// the way
+func (c *wsConn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	for c.remaining == 0 {
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if uint64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	c.unmask(p[:n])
+	c.remaining -= uint64(n)
+	return n, err
+}
+
+// unmask applies the frame mask to payload bytes
+func (c *wsConn) unmask(p []byte) {
+	if !c.masked {
+		return
+	}
+	for i := range p {
+		p[i] ^= c.mask[c.offset%4]
+		c.offset++
+	}
+}
+
+// nextFrame reads a frame header. Data frames leave their payload to
+// Read, control frames are answered here.
+func (c *wsConn) nextFrame() error {
+	var header [2]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return err
+	}
+	opcode := header[0] & 0x0f
+	c.masked = header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if !c.masked {
+		// clients must mask every frame
+		c.closeWith(1002)
+		return ErrWebSocketProtocol
+	}
+	if _, err := io.ReadFull(c.r, c.mask[:]); err != nil {
+		return err
+	}
+	c.offset = 0
+
+	switch opcode {
+	case opContinuation, opText, opBinary:
+		c.remaining = length
+		return nil
+	}
+	if length > 125 {
+		c.closeWith(1002)
+		return ErrWebSocketProtocol
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return err
+	}
+	c.unmask(payload)
+	switch opcode {
+	case opPing:
+		return c.writeFrame(opPong, payload)
+	case opPong:
+		return nil
+	case opClose:
+		c.closeWith(1000)
+		return io.EOF
+	}
+	c.closeWith(1002)
+	return ErrWebSocketProtocol
+}
+
+// writeFrame sends a single unmasked frame
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | opcode
+	switch {
+	case len(payload) < 126:
+		header[1] = byte(len(payload))
+	case len(payload) <= 0xffff:
+		header[1] = 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(len(payload)))
+	default:
+		header[1] = 127
+		header = append(header, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(len(payload)))
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if _, err := c.Conn.Write(header); err != nil {
+		return err
+	}
+	_, err := c.Conn.Write(payload)
+	return err
+}
+
+// Write sends p as a binary frame
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(opBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// closeWith sends a close frame with the status code once
+func (c *wsConn) closeWith(code uint16) {
+	c.closeOnce.Do(func() {
+		payload := make([]byte, 2)
+		binary.BigEndian.PutUint16(payload, code)
+		c.writeFrame(opClose, payload)
+	})
+}
+
+// Close sends a close frame and closes the connection. The deadline
+// keeps a peer that stopped reading from blocking the close.
+func (c *wsConn) Close() error {
+	c.Conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+	c.closeWith(1000)
+	return c.Conn.Close()
+}
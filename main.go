@@ -1,16 +1,32 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math/rand"
 	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/Defman21/prxpass-server/auth"
+	"github.com/Defman21/prxpass-server/capture"
 	"github.com/Defman21/prxpass-server/common"
+	handlerAdmin "github.com/Defman21/prxpass-server/handlers/admin"
 	handlerHTTP "github.com/Defman21/prxpass-server/handlers/http"
+	handlerSSH "github.com/Defman21/prxpass-server/handlers/ssh"
+	handlerTCP "github.com/Defman21/prxpass-server/handlers/tcp"
+	handlerUDP "github.com/Defman21/prxpass-server/handlers/udp"
 	"github.com/Defman21/prxpass-server/helpers"
+	"github.com/Defman21/prxpass-server/metrics"
 	"github.com/Defman21/prxpass-server/types"
 )
 
@@ -21,63 +37,448 @@ func init() {
 		common.Logger.Fatal(err)
 	}
 	common.Logger.Infow("Config",
-		"config", fmt.Sprintf("%+v", conf),
+		"config", fmt.Sprintf("%+v", conf.Redacted()),
 	)
 }
 
-var clients types.Clients
+var (
+	registry      *types.Registry
+	ids           helpers.IDGenerator
+	names         *types.NameStore
+	authenticator auth.Authenticator
+	// captures recent HTTP exchanges for the admin dashboard, nil when
+	// capturing is disabled
+	captures *capture.Buffer
+	// modes tunnel modes enabled by the command line flags
+	modes = make(map[string]bool)
+)
 
 func init() {
 	rand.Seed(time.Now().UTC().UnixNano())
-	clients = make(types.Clients)
+	registry = types.NewRegistry()
+	var err error
+	ids, err = helpers.NewIDGenerator(conf.IDs.Strategy, conf.IDs.Length, conf.IDs.Alphabet)
+	if err != nil {
+		common.Logger.Fatal(err)
+	}
+	if conf.Reserved.File != "" {
+		if names, err = types.LoadNameStore(conf.Reserved.File); err != nil {
+			common.Logger.Fatal(err)
+		}
+	}
+	registry.Subscribe(countTunnels)
+	registry.SetNamePolicy(types.NewNamePolicy(names, conf.Reserved.Denylist))
+	if authenticator, err = newAuthenticator(&conf.Auth); err != nil {
+		common.Logger.Fatal(err)
+	}
+}
+
+// newAuthenticator creates the authenticator of the configured backend
+func newAuthenticator(config *types.AuthConfig) (auth.Authenticator, error) {
+	backend := config.Backend
+	if backend == "" {
+		backend = "password"
+		if config.UsersFile != "" {
+			backend = "tokens"
+		}
+	}
+	if config.RequireChallenge && backend != "password" && backend != "tokens" {
+		return nil, fmt.Errorf("auth.require_challenge is not supported by the %s backend", backend)
+	}
+	switch backend {
+	case "password":
+		return &auth.Passwords{
+			Secrets: map[string]string{
+				types.ModeHTTP: conf.HTTP.Password,
+				types.ModeTCP:  conf.TCP.Password,
+				types.ModeUDP:  conf.UDP.Password,
+			},
+			RequireChallenge: config.RequireChallenge,
+		}, nil
+	case "tokens":
+		users, err := auth.LoadUsers(config.UsersFile)
+		if err != nil {
+			return nil, err
+		}
+		users.RequireChallenge = config.RequireChallenge
+		return users, nil
+	case "htpasswd":
+		return auth.LoadHtpasswd(config.HtpasswdFile)
+	case "jwt":
+		if config.JWTSecret == "" {
+			return nil, fmt.Errorf("auth.jwt_secret is not configured")
+		}
+		return &auth.JWT{
+			Secret:   []byte(config.JWTSecret),
+			Issuer:   config.JWTIssuer,
+			Audience: config.JWTAudience,
+		}, nil
+	case "webhook":
+		return auth.NewWebhook(config.WebhookURL, time.Duration(config.WebhookTimeout)*time.Second), nil
+	}
+	return nil, fmt.Errorf("unknown auth backend %q", backend)
 }
 
 func main() {
 	isHTTP := flag.Bool("http", true, "Use HTTP")
 	isTCP := flag.Bool("tcp", false, "Use TCP")
+	isUDP := flag.Bool("udp", false, "Use UDP")
+	isSSH := flag.Bool("ssh", false, "Accept ssh -R tunnels")
+	flag.Parse()
 
-	var (
-		serverAddress string
-		clientAddress string
-	)
+	if flag.Arg(0) == "reserve" {
+		reserve(flag.Args()[1:])
+		return
+	}
+	if flag.Arg(0) == "har" {
+		exportHAR(flag.Args()[1:])
+		return
+	}
+
+	modes[types.ModeHTTP] = *isHTTP
+	modes[types.ModeTCP] = *isTCP
+	modes[types.ModeUDP] = *isUDP
+
+	if _, ok := authenticator.(auth.Reloader); ok {
+		go watchAuth()
+	}
+
+	if names != nil {
+		go watchNames()
+	}
+
+	if *isTCP {
+		handler, err := handlerTCP.NewHandler(&conf.TCP)
+		if err != nil {
+			common.Logger.Fatal(err)
+		}
+		types.RegisterTunnelHandler(types.ModeTCP, handler)
+		go listenClients(conf.TCP.Client, types.ModeTCP)
+	}
 
+	if *isUDP {
+		handler, err := handlerUDP.NewHandler(&conf.UDP)
+		if err != nil {
+			common.Logger.Fatal(err)
+		}
+		types.RegisterTunnelHandler(types.ModeUDP, handler)
+		go listenClients(conf.UDP.Client, types.ModeUDP)
+	}
+
+	if *isSSH {
+		server, err := handlerSSH.NewServer(&conf, registry, ids, modes)
+		if err != nil {
+			common.Logger.Fatal(err)
+		}
+		go func() {
+			common.Logger.Fatal(server.ListenAndServe())
+		}()
+	}
+
+	if conf.Admin.Server != "" && conf.Admin.Capture.Enabled {
+		captures = capture.NewBuffer(conf.Admin.Capture.Size, conf.Admin.Capture.MaxBody)
+	}
+
+	// proxy serves the tunnel subdomains, the admin API replays captured
+	// requests through it
+	var proxy http.Handler
 	if *isHTTP {
-		clientAddr := conf.HTTP.ClientAddr
-		clientPort := conf.HTTP.ClientPort
-		clientAddress = fmt.Sprintf("%s:%d", clientAddr, clientPort)
+		proxy = handlerHTTP.NewHandler(registry, conf.HTTP.Host, conf.HTTP.MaxBodySize, captures, acceptClient)
+	}
 
-	} else if *isTCP {
-		clientAddress = conf.TCP.Client
+	if conf.Admin.Server != "" {
+		go func() {
+			common.Logger.Fatal(handlerAdmin.Handle(registry, captures, proxy, &conf.Admin))
+		}()
 	}
 
-	flag.Parse()
+	if !*isHTTP {
+		select {}
+	}
+
+	clientAddress := fmt.Sprintf("%s:%d", conf.HTTP.ClientAddr, conf.HTTP.ClientPort)
+	go listenClients(clientAddress, types.ModeHTTP)
+
+	serverAddress := fmt.Sprintf("%s:%d", conf.HTTP.ServerAddr, conf.HTTP.ServerPort)
+
+	handlerHTTP.Handle(proxy, conf.HTTP.TLS.Enabled, serverAddress, conf.HTTP.Host, conf.HTTP.TLS.Cert, conf.HTTP.TLS.Key)
+}
+
+// controlTLS the TLS config of the control listeners, nil when disabled
+func controlTLS(config *types.ControlTLSConfig) (*tls.Config, error) {
+	if !config.Enabled {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(config.Cert, config.Key)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if config.ClientCA != "" {
+		pem, err := ioutil.ReadFile(config.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", config.ClientCA)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	if config.RequireClientCert {
+		if tlsConfig.ClientCAs == nil {
+			return nil, fmt.Errorf("control.tls.require_client_cert needs client_ca")
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// listenClients accepts control connections of the given mode
+func listenClients(clientAddress string, mode string) {
 	ln, err := net.Listen("tcp", clientAddress)
 	common.Logger.Infow("Listening [clients]",
 		"address", clientAddress,
+		"mode", mode,
+		"tls", conf.Control.TLS.Enabled,
 	)
 
 	if err != nil {
 		common.Logger.Fatal(err)
 	}
+	tlsConfig, err := controlTLS(&conf.Control.TLS)
+	if err != nil {
+		common.Logger.Fatal(err)
+	}
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
 
-	go func() {
-		for {
-			con, err := ln.Accept()
-			id := helpers.ID()
-			common.Logger.Infow("Client connected",
-				"con", con,
+	for {
+		con, err := ln.Accept()
+		common.Logger.Infow("Client connected",
+			"con", con,
+		)
+
+		if err != nil {
+			common.Logger.Fatal(err)
+		}
+
+		if tlsConfig != nil {
+			metrics.ControlConnections.With("tls").Inc()
+		} else {
+			metrics.ControlConnections.With("tcp").Inc()
+		}
+		// the TLS handshake must not hold up the accept loop
+		go acceptClient(con, mode)
+	}
+}
+
+// acceptClient starts serving a control connection, whichever transport
+// it arrived on
+func acceptClient(con net.Conn, mode string) {
+	if !modes[mode] {
+		common.Logger.Warnw("Tunnel mode not enabled",
+			"mode", mode,
+		)
+		con.Close()
+		return
+	}
+	if tlsCon, ok := con.(*tls.Conn); ok {
+		// a peer that stays silent would otherwise hold the connection
+		// forever, nothing reads from it before the handshake
+		tlsCon.SetDeadline(time.Now().Add(types.HandshakeTimeout))
+		if err := tlsCon.Handshake(); err != nil {
+			common.Logger.Warnw("TLS handshake failed",
+				"remote", con.RemoteAddr().String(),
+				"err", err,
+			)
+			con.Close()
+			return
+		}
+		tlsCon.SetDeadline(time.Time{})
+	}
+	id, err := registry.Allocate(ids)
+	if err != nil {
+		common.Logger.Warnw("ID allocation failed",
+			"err", err,
+		)
+		con.Close()
+		return
+	}
+	cl := types.NewClient(con, mode)
+	go cl.Reader(registry, id, &conf, authenticator)
+}
+
+// countTunnels keeps the active tunnels gauge up to date
+func countTunnels(event types.RegistryEvent) {
+	switch event.Type {
+	case types.EventRegister:
+		metrics.TunnelsActive.With(event.Client.Mode).Add(1)
+	case types.EventUnregister:
+		metrics.TunnelsActive.With(event.Client.Mode).Add(-1)
+	}
+}
+
+// reserve reserves a subdomain and prints the owner token
+func reserve(args []string) {
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, "usage: prxpass-server reserve <name> [owner]")
+		os.Exit(2)
+	}
+	if names == nil {
+		common.Logger.Fatal("reserved.file is not configured")
+	}
+	owner := ""
+	if len(args) > 1 {
+		owner = args[1]
+	}
+	token, err := (&helpers.RandomIDs{Length: 32, Alphabet: helpers.DefaultIDAlphabet}).ID()
+	if err != nil {
+		common.Logger.Fatal(err)
+	}
+	if err := names.Reserve(args[0], owner, token); err != nil {
+		common.Logger.Fatal(err)
+	}
+	fmt.Println(token)
+}
+
+// exportHAR fetches captured exchanges from the admin API of the running
+// server and writes them as HAR
+func exportHAR(args []string) {
+	flags := flag.NewFlagSet("har", flag.ExitOnError)
+	tunnel := flags.String("tunnel", "", "Only export this tunnel")
+	since := flags.String("since", "", "Start of the window, an RFC 3339 time or a duration ago such as 15m")
+	until := flags.String("until", "", "End of the window, an RFC 3339 time or a duration ago")
+	output := flags.String("o", "", "Write to this file instead of stdout")
+	flags.Parse(args)
+	if conf.Admin.Server == "" {
+		common.Logger.Fatal("admin.server is not configured")
+	}
+	query := url.Values{}
+	if *tunnel != "" {
+		query.Set("tunnel", *tunnel)
+	}
+	now := time.Now()
+	for name, value := range map[string]string{"since": *since, "until": *until} {
+		t, err := windowTime(value, now)
+		if err != nil {
+			common.Logger.Fatalf("-%s: %v", name, err)
+		}
+		if t != "" {
+			query.Set(name, t)
+		}
+	}
+	host, port, err := net.SplitHostPort(conf.Admin.Server)
+	if err != nil {
+		common.Logger.Fatal(err)
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	endpoint := "http://" + net.JoinHostPort(host, port) + "/api/har?" + query.Encode()
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		common.Logger.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+conf.Admin.Token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		common.Logger.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		common.Logger.Fatalf("admin API: %s: %s", resp.Status, body)
+	}
+	out := os.Stdout
+	if *output != "" {
+		if out, err = os.Create(*output); err != nil {
+			common.Logger.Fatal(err)
+		}
+		defer out.Close()
+	}
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		common.Logger.Fatal(err)
+	}
+}
+
+// windowTime an RFC 3339 time, or one a duration before now
+func windowTime(value string, now time.Time) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d).Format(time.RFC3339), nil
+	}
+	if _, err := time.Parse(time.RFC3339, value); err != nil {
+		return "", fmt.Errorf("expected an RFC 3339 time or a duration: %v", value)
+	}
+	return value, nil
+}
+
+// watchAuth reloads the users or htpasswd file when it changes or on
+// SIGHUP, tunnels of revoked identities are disconnected
+func watchAuth() {
+	reloader := authenticator.(auth.Reloader)
+	reloader.OnReload(revokeTunnels)
+	go reloader.Watch(reloadInterval())
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := reloader.Reload(); err != nil {
+			common.Logger.Warnw("Auth reload failed",
+				"err", err,
 			)
+			continue
+		}
+		common.Logger.Infow("Auth reloaded")
+	}
+}
 
-			if err != nil {
-				common.Logger.Fatal(err)
-			}
+// watchNames reloads the reserved names when the reserve subcommand of
+// another process changes them or on SIGHUP
+func watchNames() {
+	go names.Watch(reloadInterval())
 
-			cl := types.NewClient(con)
-			go cl.Reader(&clients, id, &conf.HTTP)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := names.Reload(); err != nil {
+			common.Logger.Warnw("Reserved names reload failed",
+				"err", err,
+			)
+			continue
 		}
-	}()
+		common.Logger.Infow("Reserved names reloaded")
+	}
+}
 
-	serverAddress = fmt.Sprintf("%s:%d", conf.HTTP.ServerAddr, conf.HTTP.ServerPort)
+// reloadInterval how often watched files are checked for changes
+func reloadInterval() time.Duration {
+	if conf.Auth.ReloadInterval > 0 {
+		return time.Duration(conf.Auth.ReloadInterval) * time.Second
+	}
+	return 10 * time.Second
+}
 
-	handlerHTTP.Handle(&clients, conf.HTTP.TLS.Enabled, serverAddress, conf.HTTP.Host, conf.HTTP.TLS.Cert, conf.HTTP.TLS.Key)
+// revokeTunnels disconnects tunnels whose identity is no longer valid
+func revokeTunnels() {
+	validator, ok := authenticator.(auth.Validator)
+	if !ok {
+		return
+	}
+	for _, id := range registry.List() {
+		cl, ok := registry.Lookup(id)
+		if !ok || cl.Identity == nil || validator.Valid(cl.Identity) {
+			continue
+		}
+		common.Logger.Warnw("Tunnel revoked",
+			"id", id,
+			"user", cl.Identity.Name,
+		)
+		cl.Conn.Close()
+	}
 }
@@ -0,0 +1,306 @@
+// Package metrics implements counters, gauges and histograms exposed in
+// the Prometheus text format
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// collector a metric family that can write itself
+type collector interface {
+	write(w io.Writer)
+}
+
+// Registry a set of metric families
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+// Default the registry served by Handler
+var Default = &Registry{}
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// WriteText writes every metric in the Prometheus text format
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	collectors := r.collectors
+	r.mu.Unlock()
+	buf := bufio.NewWriter(w)
+	for _, c := range collectors {
+		c.write(buf)
+	}
+	return buf.Flush()
+}
+
+// Handler serves the default registry
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		Default.WriteText(w)
+	})
+}
+
+// family the shared part of labeled metric families
+type family struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+	mu     sync.Mutex
+	series map[string]*series
+	keys   []string
+}
+
+// series a metric and its label values
+type series struct {
+	values []string
+	metric interface{}
+}
+
+func newFamily(name, help, kind string, labels []string) *family {
+	return &family{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		series: make(map[string]*series),
+	}
+}
+
+// get returns the series of the label values, creating it with create
+func (f *family) get(values []string, create func() interface{}) interface{} {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+	key := f.labelString(values, "", "")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{values: append([]string(nil), values...), metric: create()}
+		f.series[key] = s
+		f.keys = append(f.keys, key)
+		sort.Strings(f.keys)
+	}
+	return s.metric
+}
+
+// labelString formats label pairs, extra adds one more pair
+func (f *family) labelString(values []string, extraName, extraValue string) string {
+	pairs := make([]string, 0, len(values)+1)
+	for i, value := range values {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", f.labels[i], escape(value)))
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", extraName, escape(extraValue)))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// each calls fn for every series in label order
+func (f *family) each(fn func(labels string, s *series)) {
+	f.mu.Lock()
+	keys := append([]string(nil), f.keys...)
+	all := make([]*series, len(keys))
+	for i, key := range keys {
+		all[i] = f.series[key]
+	}
+	f.mu.Unlock()
+	for i, key := range keys {
+		fn(key, all[i])
+	}
+}
+
+func (f *family) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escape(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, +1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Counter a monotonically increasing value
+type Counter struct {
+	value uint64
+}
+
+// Inc adds one
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+// Add adds n
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.value, n)
+}
+
+// Value the current value
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+// CounterVec counters partitioned by labels
+type CounterVec struct {
+	*family
+}
+
+// NewCounterVec creates and registers a counter family
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	v := &CounterVec{newFamily(name, help, "counter", labels)}
+	Default.register(v)
+	return v
+}
+
+// With the counter of the label values
+func (v *CounterVec) With(values ...string) *Counter {
+	return v.get(values, func() interface{} { return &Counter{} }).(*Counter)
+}
+
+func (v *CounterVec) write(w io.Writer) {
+	v.header(w)
+	v.each(func(labels string, s *series) {
+		fmt.Fprintf(w, "%s%s %d\n", v.name, labels, s.metric.(*Counter).Value())
+	})
+}
+
+// Gauge a value that goes up and down
+type Gauge struct {
+	value int64
+}
+
+// Add adds n, which may be negative
+func (g *Gauge) Add(n int64) {
+	atomic.AddInt64(&g.value, n)
+}
+
+// Set sets the value
+func (g *Gauge) Set(n int64) {
+	atomic.StoreInt64(&g.value, n)
+}
+
+// Value the current value
+func (g *Gauge) Value() int64 {
+	return atomic.LoadInt64(&g.value)
+}
+
+// GaugeVec gauges partitioned by labels
+type GaugeVec struct {
+	*family
+}
+
+// NewGaugeVec creates and registers a gauge family
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	v := &GaugeVec{newFamily(name, help, "gauge", labels)}
+	Default.register(v)
+	return v
+}
+
+// With the gauge of the label values
+func (v *GaugeVec) With(values ...string) *Gauge {
+	return v.get(values, func() interface{} { return &Gauge{} }).(*Gauge)
+}
+
+func (v *GaugeVec) write(w io.Writer) {
+	v.header(w)
+	v.each(func(labels string, s *series) {
+		fmt.Fprintf(w, "%s%s %d\n", v.name, labels, s.metric.(*Gauge).Value())
+	})
+}
+
+// DefaultBuckets latency buckets in seconds
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Histogram counts observations in buckets
+type Histogram struct {
+	buckets []float64
+	mu      sync.Mutex
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+// Observe records a value
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, upper := range h.buckets {
+		if v <= upper {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// HistogramVec histograms partitioned by labels
+type HistogramVec struct {
+	*family
+	buckets []float64
+}
+
+// NewHistogramVec creates and registers a histogram family, nil buckets
+// use DefaultBuckets
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	v := &HistogramVec{
+		family:  newFamily(name, help, "histogram", labels),
+		buckets: append(buckets, math.Inf(+1)),
+	}
+	Default.register(v)
+	return v
+}
+
+// With the histogram of the label values
+func (v *HistogramVec) With(values ...string) *Histogram {
+	return v.get(values, func() interface{} {
+		return &Histogram{
+			buckets: v.buckets,
+			counts:  make([]uint64, len(v.buckets)),
+		}
+	}).(*Histogram)
+}
+
+func (v *HistogramVec) write(w io.Writer) {
+	v.header(w)
+	v.each(func(labels string, s *series) {
+		h := s.metric.(*Histogram)
+		h.mu.Lock()
+		counts := append([]uint64(nil), h.counts...)
+		sum, count := h.sum, h.count
+		h.mu.Unlock()
+		for i, upper := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, v.labelString(s.values, "le", formatFloat(upper)), counts[i])
+		}
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.name, labels, formatFloat(sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.name, labels, count)
+	})
+}
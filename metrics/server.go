@@ -0,0 +1,26 @@
+package metrics
+
+// Server metrics
+var (
+	// TunnelsActive registered tunnels by type
+	TunnelsActive = NewGaugeVec("prxpass_tunnels_active",
+		"Registered tunnels by type.", "type")
+	// ControlConnections control connections accepted by transport
+	ControlConnections = NewCounterVec("prxpass_control_connections_total",
+		"Control connections accepted by transport.", "transport")
+	// AuthFailures rejected clients by front end, control or ssh
+	AuthFailures = NewCounterVec("prxpass_auth_failures_total",
+		"Clients rejected by authentication by front end.", "frontend")
+	// HTTPRequests proxied HTTP requests by status class
+	HTTPRequests = NewCounterVec("prxpass_http_requests_total",
+		"Proxied HTTP requests by status class.", "code")
+	// HTTPDuration proxied HTTP request latency by status class
+	HTTPDuration = NewHistogramVec("prxpass_http_request_duration_seconds",
+		"Proxied HTTP request latency by status class.", nil, "code")
+	// TunnelBytes bytes carried for tunnels, in from and out to clients
+	TunnelBytes = NewCounterVec("prxpass_tunnel_bytes_total",
+		"Bytes received from (in) and sent to (out) clients.", "direction")
+	// RPCs control RPCs by method and direction
+	RPCs = NewCounterVec("prxpass_rpc_total",
+		"Control RPCs by method, in from and out to clients.", "method", "direction")
+)
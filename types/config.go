@@ -1,15 +1,24 @@
 package types
 
+import (
+	"fmt"
+)
+
 // HTTPConfig TOML HTTP config section
 type HTTPConfig struct {
-	ClientAddr string `toml:"client_addr"`
-	ClientPort int    `toml:"client_port"`
-	ServerAddr string `toml:"server_addr"`
-	ServerPort int    `toml:"server_port"`
-	Host       string
-	CustomIDs  bool `toml:"custom_ids"`
-	TLS        HTTPTLSConfig
-	Password   string
+	ClientAddr   string `toml:"client_addr"`
+	ClientPort   int    `toml:"client_port"`
+	ServerAddr   string `toml:"server_addr"`
+	ServerPort   int    `toml:"server_port"`
+	Host         string
+	CustomIDs    bool `toml:"custom_ids"`
+	TLS          HTTPTLSConfig
+	Password     string
+	MaxFrameSize int   `toml:"max_frame_size"`
+	MaxBodySize  int64 `toml:"max_body_size"`
+	// heartbeat settings in seconds
+	HeartbeatInterval int `toml:"heartbeat_interval"`
+	HeartbeatTimeout  int `toml:"heartbeat_timeout"`
 }
 
 // HTTPTLSConfig TOML HTTP TLS config section
@@ -19,15 +28,135 @@ type HTTPTLSConfig struct {
 	Key     string
 }
 
+// SSHConfig TOML SSH front end config section
+type SSHConfig struct {
+	Server string
+	// HostKey PEM private key, generated when missing
+	HostKey string `toml:"host_key"`
+	// AuthorizedKeys public keys allowed to open tunnels, the key comment
+	// names the user
+	AuthorizedKeys string `toml:"authorized_keys"`
+}
+
+// AdminConfig TOML admin API config section
+type AdminConfig struct {
+	// Server listen address, empty disables the admin API
+	Server string
+	// Token bearer token of the admin API
+	Token   string
+	Capture CaptureConfig `toml:"capture"`
+}
+
+// CaptureConfig TOML request inspector config section
+type CaptureConfig struct {
+	// Enabled keeps recent HTTP exchanges for the admin dashboard
+	Enabled bool
+	// Size exchanges kept across all tunnels
+	Size int
+	// MaxBody bytes kept of each request and response body
+	MaxBody int `toml:"max_body"`
+}
+
+// ControlTLSConfig TOML control listener TLS config section
+type ControlTLSConfig struct {
+	Enabled bool
+	Cert    string
+	Key     string
+	// ClientCA PEM bundle that verifies client certificates, a verified
+	// certificate authenticates the client as its subject
+	ClientCA string `toml:"client_ca"`
+	// RequireClientCert refuses clients without a verified certificate
+	RequireClientCert bool `toml:"require_client_cert"`
+}
+
+// ControlConfig TOML client control listener config section
+type ControlConfig struct {
+	TLS ControlTLSConfig `toml:"tls"`
+}
+
 // TCPConfig TOML TCP config section
 type TCPConfig struct {
 	Client   string
 	Server   string
+	Host     string
+	PortMin  int `toml:"port_min"`
+	PortMax  int `toml:"port_max"`
 	Password string
 }
 
+// UDPConfig TOML UDP config section
+type UDPConfig struct {
+	Client      string
+	Server      string
+	Host        string
+	PortMin     int `toml:"port_min"`
+	PortMax     int `toml:"port_max"`
+	IdleTimeout int `toml:"idle_timeout"`
+	Password    string
+}
+
+// IDConfig TOML tunnel ID generation config section
+type IDConfig struct {
+	Strategy string
+	Length   int
+	Alphabet string
+}
+
+// ReservedConfig TOML reserved subdomains config section
+type ReservedConfig struct {
+	File     string
+	Denylist []string
+}
+
+// AuthConfig TOML authentication config section
+type AuthConfig struct {
+	// Backend password, tokens, htpasswd, jwt or webhook. Empty selects
+	// tokens when a users file is set and password otherwise.
+	Backend   string
+	UsersFile string `toml:"users_file"`
+	// ReloadInterval seconds between checks of the users or htpasswd file
+	ReloadInterval int    `toml:"reload_interval"`
+	HtpasswdFile   string `toml:"htpasswd_file"`
+	JWTSecret      string `toml:"jwt_secret"`
+	JWTIssuer      string `toml:"jwt_issuer"`
+	JWTAudience    string `toml:"jwt_audience"`
+	// RequireChallenge refuses passwords and tokens sent in clear text,
+	// clients must answer the net/challenge instead
+	RequireChallenge bool   `toml:"require_challenge"`
+	WebhookURL       string `toml:"webhook_url"`
+	// WebhookTimeout seconds
+	WebhookTimeout int `toml:"webhook_timeout"`
+}
+
 // Config TOML config
 type Config struct {
-	HTTP HTTPConfig `toml:"http"`
-	TCP  TCPConfig  `toml:"tcp"`
+	HTTP     HTTPConfig     `toml:"http"`
+	TCP      TCPConfig      `toml:"tcp"`
+	UDP      UDPConfig      `toml:"udp"`
+	IDs      IDConfig       `toml:"ids"`
+	Reserved ReservedConfig `toml:"reserved"`
+	Auth     AuthConfig     `toml:"auth"`
+	Control  ControlConfig  `toml:"control"`
+	SSH      SSHConfig      `toml:"ssh"`
+	Admin    AdminConfig    `toml:"admin"`
+}
+
+// HTTPAddress the public address of an HTTP tunnel
+func (c *Config) HTTPAddress(id string) string {
+	return fmt.Sprintf("http://%s.%s:%d/", id, c.HTTP.Host, c.HTTP.ServerPort)
+}
+
+// Redacted a copy of the config without secrets, safe to log
+func (c Config) Redacted() Config {
+	redact := func(secret *string) {
+		if *secret != "" {
+			*secret = "[redacted]"
+		}
+	}
+	redact(&c.HTTP.Password)
+	redact(&c.TCP.Password)
+	redact(&c.UDP.Password)
+	redact(&c.Auth.JWTSecret)
+	redact(&c.Admin.Token)
+	return c
 }
@@ -0,0 +1,51 @@
+package types
+
+const (
+	// FeatureStreams stream multiplexing over the control connection
+	FeatureStreams = "streams"
+	// FeatureWebSockets HTTP upgrade passthrough
+	FeatureWebSockets = "websockets"
+	// FeatureTCP raw TCP tunnels
+	FeatureTCP = "tcp"
+	// FeatureUDP UDP tunnels
+	FeatureUDP = "udp"
+)
+
+// ServerFeatures features this server implements
+var ServerFeatures = []string{FeatureStreams, FeatureWebSockets, FeatureTCP, FeatureUDP}
+
+// featureRequires features that only work on top of another one
+var featureRequires = map[string]string{
+	FeatureWebSockets: FeatureStreams,
+	FeatureTCP:        FeatureStreams,
+}
+
+// Supports reports whether the client enabled a feature
+func (c *Client) Supports(feature string) bool {
+	c.featuresMu.RLock()
+	defer c.featuresMu.RUnlock()
+	return c.features[feature]
+}
+
+// enableFeatures enables the requested features the server implements
+// and returns the enabled ones
+func (c *Client) enableFeatures(requested []string) []string {
+	wanted := make(map[string]bool, len(requested))
+	for _, feature := range requested {
+		wanted[feature] = true
+	}
+	c.featuresMu.Lock()
+	defer c.featuresMu.Unlock()
+	enabled := []string{}
+	for _, feature := range ServerFeatures {
+		if !wanted[feature] {
+			continue
+		}
+		if dep, ok := featureRequires[feature]; ok && !wanted[dep] {
+			continue
+		}
+		c.features[feature] = true
+		enabled = append(enabled, feature)
+	}
+	return enabled
+}
@@ -0,0 +1,70 @@
+package types
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// DefaultMaxFrameSize default limit for a single frame payload
+const DefaultMaxFrameSize = 4 << 20
+
+// frameHeaderSize size of the big-endian length prefix
+const frameHeaderSize = 4
+
+// ErrFrameTooLarge a frame exceeds the max frame size
+var ErrFrameTooLarge = errors.New("frame exceeds max frame size")
+
+// EncodeFrame prefixes the payload with its length
+func EncodeFrame(payload []byte, max int) ([]byte, error) {
+	if max <= 0 {
+		max = DefaultMaxFrameSize
+	}
+	if len(payload) > max {
+		return nil, ErrFrameTooLarge
+	}
+	frame := make([]byte, frameHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	copy(frame[frameHeaderSize:], payload)
+	return frame, nil
+}
+
+// FrameDecoder a streaming decoder of length-prefixed frames.
+// Partial reads are buffered until a frame is complete and coalesced
+// frames are returned one by one.
+type FrameDecoder struct {
+	r   *bufio.Reader
+	max int
+}
+
+// NewFrameDecoder creates a frame decoder
+func NewFrameDecoder(r io.Reader, max int) *FrameDecoder {
+	if max <= 0 {
+		max = DefaultMaxFrameSize
+	}
+	return &FrameDecoder{
+		r:   bufio.NewReader(r),
+		max: max,
+	}
+}
+
+// Next reads the next frame payload
+func (d *FrameDecoder) Next() ([]byte, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(d.r, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if uint64(size) > uint64(d.max) {
+		return nil, ErrFrameTooLarge
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(d.r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return payload, nil
+}
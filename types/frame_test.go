@@ -0,0 +1,155 @@
+package types
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// chunkReader returns its chunks one Read at a time, like a socket that
+// splits or coalesces writes
+type chunkReader struct {
+	chunks [][]byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.chunks[0])
+	if n < len(r.chunks[0]) {
+		r.chunks[0] = r.chunks[0][n:]
+	} else {
+		r.chunks = r.chunks[1:]
+	}
+	return n, nil
+}
+
+func mustFrame(t *testing.T, payload string) []byte {
+	frame, err := EncodeFrame([]byte(payload), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+func TestFrameDecoder(t *testing.T) {
+	hello := mustFrame(t, "hello")
+	world := mustFrame(t, "world")
+	tests := []struct {
+		name   string
+		chunks [][]byte
+		max    int
+		want   []string
+		err    error
+	}{
+		{
+			name:   "whole frame",
+			chunks: [][]byte{hello},
+			want:   []string{"hello"},
+			err:    io.EOF,
+		},
+		{
+			name:   "split header",
+			chunks: [][]byte{hello[:2], hello[2:]},
+			want:   []string{"hello"},
+			err:    io.EOF,
+		},
+		{
+			name:   "split payload",
+			chunks: [][]byte{hello[:6], hello[6:7], hello[7:]},
+			want:   []string{"hello"},
+			err:    io.EOF,
+		},
+		{
+			name:   "byte by byte",
+			chunks: bytesOf(hello),
+			want:   []string{"hello"},
+			err:    io.EOF,
+		},
+		{
+			name:   "two frames in one read",
+			chunks: [][]byte{append(append([]byte{}, hello...), world...)},
+			want:   []string{"hello", "world"},
+			err:    io.EOF,
+		},
+		{
+			name:   "second frame split across reads",
+			chunks: [][]byte{append(append([]byte{}, hello...), world[:3]...), world[3:]},
+			want:   []string{"hello", "world"},
+			err:    io.EOF,
+		},
+		{
+			name:   "empty frame",
+			chunks: [][]byte{mustFrame(t, ""), hello},
+			want:   []string{"", "hello"},
+			err:    io.EOF,
+		},
+		{
+			name:   "oversize frame",
+			chunks: [][]byte{hello},
+			max:    4,
+			err:    ErrFrameTooLarge,
+		},
+		{
+			name:   "truncated header",
+			chunks: [][]byte{hello[:2]},
+			err:    io.ErrUnexpectedEOF,
+		},
+		{
+			name:   "truncated payload",
+			chunks: [][]byte{hello[:7]},
+			err:    io.ErrUnexpectedEOF,
+		},
+		{
+			name:   "truncated after a frame",
+			chunks: [][]byte{hello, world[:6]},
+			want:   []string{"hello"},
+			err:    io.ErrUnexpectedEOF,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewFrameDecoder(&chunkReader{chunks: tt.chunks}, tt.max)
+			got := []string{}
+			for {
+				payload, err := d.Next()
+				if err != nil {
+					if err != tt.err {
+						t.Fatalf("err = %v, want %v", err, tt.err)
+					}
+					break
+				}
+				got = append(got, string(payload))
+			}
+			if len(tt.want) == 0 {
+				tt.want = []string{}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("frames = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeFrame(t *testing.T) {
+	frame, err := EncodeFrame([]byte("abc"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0, 0, 0, 3, 'a', 'b', 'c'}; !bytes.Equal(frame, want) {
+		t.Fatalf("frame = %v, want %v", frame, want)
+	}
+	if _, err := EncodeFrame([]byte("abcde"), 4); err != ErrFrameTooLarge {
+		t.Fatalf("err = %v, want %v", err, ErrFrameTooLarge)
+	}
+}
+
+func bytesOf(b []byte) [][]byte {
+	chunks := make([][]byte, len(b))
+	for i := range b {
+		chunks[i] = b[i : i+1]
+	}
+	return chunks
+}
@@ -0,0 +1,130 @@
+package types
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/Defman21/prxpass-server/auth"
+)
+
+// SupportedVersions protocol versions the server speaks
+var SupportedVersions = []int{ProtocolVersion1, ProtocolVersion2}
+
+var (
+	// ErrUnsupportedVersion no protocol version in common with the client
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+	// ErrHandshakeDone net/hello was sent twice or after other RPCs
+	ErrHandshakeDone = errors.New("handshake already done")
+	// ErrAlreadyRegistered net/register was sent on a registered connection
+	ErrAlreadyRegistered = errors.New("already registered")
+)
+
+// chooseVersion picks the highest offered version the server speaks
+func chooseVersion(offered []int) (int, bool) {
+	chosen := 0
+	for _, version := range offered {
+		for _, supported := range SupportedVersions {
+			if version == supported && version > chosen {
+				chosen = version
+			}
+		}
+	}
+	return chosen, chosen != 0
+}
+
+// hello handles the net/hello handshake: the client offers protocol
+// versions and capabilities, the server answers with net/welcome
+// carrying the chosen version and the enabled capabilities
+func (c *Client) hello(msg *Message) error {
+	if atomic.LoadInt32(&c.version) != 0 {
+		return ErrHandshakeDone
+	}
+	offered := msg.Versions
+	if len(offered) == 0 {
+		offered = []int{msg.Version}
+	}
+	version, ok := chooseVersion(offered)
+	if !ok {
+		return fmt.Errorf("%v: offered %v, supported %v", ErrUnsupportedVersion, offered, SupportedVersions)
+	}
+	if !atomic.CompareAndSwapInt32(&c.version, 0, int32(version)) {
+		return ErrHandshakeDone
+	}
+	enabled := c.enableFeatures(msg.Capabilities)
+	welcome := c.NewRPC("net/welcome", "", nil)
+	welcome.Versions = []int{version}
+	welcome.Capabilities = enabled
+	return c.Send(welcome)
+}
+
+// checkVersion validates the version of a message. Clients that skip
+// the handshake settle on the version of their first message.
+func (c *Client) checkVersion(version int) error {
+	current := int(atomic.LoadInt32(&c.version))
+	if current == 0 {
+		if _, ok := chooseVersion([]int{version}); !ok {
+			return ErrUnsupportedVersion
+		}
+		c.negotiate(version)
+		return nil
+	}
+	if version != current {
+		return fmt.Errorf("%v: expected %d, got %d", ErrUnsupportedVersion, current, version)
+	}
+	return nil
+}
+
+// nonceSize random bytes in a challenge nonce
+const nonceSize = 32
+
+// challenge sends a fresh nonce and the client ID on connect. The client
+// answers in net/register with auth.ChallengeResponse, so the secret
+// itself never crosses the wire.
+func (c *Client) challenge(id string) (string, error) {
+	buf := make([]byte, nonceSize)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	nonce := hex.EncodeToString(buf)
+	return nonce, c.Send(c.NewRPC("net/challenge", "", nil, nonce, id))
+}
+
+// authenticate identifies the client by its verified TLS client
+// certificate, or by the credentials it registered with
+func (c *Client) authenticate(authenticator auth.Authenticator, creds *auth.Credentials) (*auth.Identity, error) {
+	if con, ok := c.Conn.(*tls.Conn); ok {
+		state := con.ConnectionState()
+		if len(state.VerifiedChains) > 0 {
+			return auth.CertificateIdentity(state.VerifiedChains[0][0]), nil
+		}
+	}
+	return authenticator.Authenticate(creds)
+}
+
+// reject sends a rejection RPC and closes the connection
+func (c *Client) reject(method, reason string) {
+	c.Send(c.NewRPC(method, "", nil, reason))
+	c.Conn.Close()
+}
+
+// registerParams named net/register parameters. Version 1 sends them
+// positionally: id, password, port, token, user, response, reserve_token.
+func registerParams(msg *Message) map[string]string {
+	if msg.Version >= ProtocolVersion2 {
+		if msg.Params == nil {
+			return map[string]string{}
+		}
+		return msg.Params
+	}
+	params := make(map[string]string)
+	for i, name := range []string{"id", "password", "port", "token", "user", "response", "reserve_token"} {
+		if i < len(msg.Args) {
+			params[name] = msg.Args[i]
+		}
+	}
+	return params
+}
@@ -0,0 +1,74 @@
+package types
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/Defman21/prxpass-server/common"
+)
+
+const (
+	// DefaultHeartbeatInterval how often the server pings a client
+	DefaultHeartbeatInterval = 30 * time.Second
+	// DefaultHeartbeatTimeout silence after which a client is evicted
+	DefaultHeartbeatTimeout = 90 * time.Second
+	// HandshakeTimeout how long a new connection may take to complete its
+	// TLS handshake and take the challenge
+	HandshakeTimeout = 10 * time.Second
+)
+
+// seen records that the client just sent something
+func (c *Client) seen() {
+	atomic.StoreInt64(&c.lastSeen, time.Now().UnixNano())
+}
+
+// LastSeen when the client last sent a message
+func (c *Client) LastSeen() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.lastSeen))
+}
+
+// heartbeat pings the client every interval and evicts it once it has
+// been silent for longer than timeout. Closing the connection makes the
+// reading goroutine fail pending requests and streams.
+func (c *Client) heartbeat(id string, interval, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			if silence := now.Sub(c.LastSeen()); silence > timeout {
+				common.Logger.Warnw("Client evicted",
+					"id", id,
+					"reason", "heartbeat timeout",
+					"silence", silence.String(),
+				)
+				c.Conn.Close()
+				return
+			}
+			err := c.Send(c.NewRPC("net/ping", "", nil, strconv.FormatInt(now.UnixNano(), 10)))
+			if err != nil {
+				common.Logger.Warnw("Send error",
+					"id", id,
+					"method", "net/ping",
+					"err", err,
+				)
+			}
+		case <-c.Close:
+			return
+		}
+	}
+}
+
+// HeartbeatDurations heartbeat interval and timeout from the config
+func HeartbeatDurations(config *HTTPConfig) (time.Duration, time.Duration) {
+	interval := DefaultHeartbeatInterval
+	if config.HeartbeatInterval > 0 {
+		interval = time.Duration(config.HeartbeatInterval) * time.Second
+	}
+	timeout := DefaultHeartbeatTimeout
+	if config.HeartbeatTimeout > 0 {
+		timeout = time.Duration(config.HeartbeatTimeout) * time.Second
+	}
+	return interval, timeout
+}
@@ -0,0 +1,81 @@
+package types
+
+import (
+	"strconv"
+	"sync/atomic"
+)
+
+const (
+	// ProtocolVersion1 string-only RPC arguments
+	ProtocolVersion1 = 1
+	// ProtocolVersion2 typed stream ID, status, headers and binary body
+	ProtocolVersion2 = 2
+	// MaxProtocolVersion highest version the server speaks
+	MaxProtocolVersion = ProtocolVersion2
+)
+
+// Version protocol version negotiated with the client
+func (c *Client) Version() int {
+	if v := atomic.LoadInt32(&c.version); v != 0 {
+		return int(v)
+	}
+	return ProtocolVersion1
+}
+
+// negotiate settles the protocol version on the first message of a
+// client that skipped the net/hello handshake
+func (c *Client) negotiate(version int) {
+	atomic.CompareAndSwapInt32(&c.version, 0, int32(version))
+}
+
+// NewRPC creates a message in the negotiated version. Version 1
+// carries the stream ID as the first and the body as the last argument.
+func (c *Client) NewRPC(method, streamID string, body []byte, args ...string) *Message {
+	if c.Version() >= ProtocolVersion2 {
+		sid, _ := strconv.ParseUint(streamID, 10, 64)
+		return &Message{
+			Sender:   "server",
+			Version:  ProtocolVersion2,
+			RPC:      RPC{Method: method, Args: args},
+			StreamID: sid,
+			Body:     body,
+		}
+	}
+	v1Args := []string{}
+	if streamID != "" {
+		v1Args = append(v1Args, streamID)
+	}
+	v1Args = append(v1Args, args...)
+	if body != nil {
+		v1Args = append(v1Args, string(body))
+	}
+	return &Message{
+		Sender:  "server",
+		Version: ProtocolVersion1,
+		RPC:     RPC{Method: method, Args: v1Args},
+	}
+}
+
+// StreamRef returns the stream ID of a stream-addressed message and the
+// remaining arguments
+func (m *Message) StreamRef() (string, []string, bool) {
+	if m.Version >= ProtocolVersion2 {
+		return strconv.FormatUint(m.StreamID, 10), m.Args, m.StreamID != 0
+	}
+	if len(m.Args) < 1 {
+		return "", nil, false
+	}
+	return m.Args[0], m.Args[1:], true
+}
+
+// Payload returns the body of a message and the arguments preceding it.
+// Version 1 carries the body as the last argument.
+func (m *Message) Payload(args []string) ([]byte, []string, bool) {
+	if m.Version >= ProtocolVersion2 {
+		return m.Body, args, true
+	}
+	if len(args) < 1 {
+		return nil, nil, false
+	}
+	return []byte(args[len(args)-1]), args[:len(args)-1], true
+}
@@ -0,0 +1,241 @@
+package types
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Defman21/prxpass-server/auth"
+	"github.com/Defman21/prxpass-server/common"
+)
+
+// DefaultDenylist names nobody may claim as a custom ID
+var DefaultDenylist = []string{"www", "admin", "api", "mail", "ftp", "ns1", "ns2", "status", "prxpass"}
+
+var (
+	// ErrInvalidID the custom ID is not a valid DNS label
+	ErrInvalidID = errors.New("id is not a valid dns label")
+	// ErrDeniedID the custom ID is on the denylist
+	ErrDeniedID = errors.New("id is not available")
+	// ErrNotOwner the custom ID is reserved by someone else
+	ErrNotOwner = errors.New("id is reserved")
+)
+
+// labelRe a DNS label in lower case
+var labelRe = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// Reservation a subdomain reserved for a user or the holder of a token
+type Reservation struct {
+	Owner     string `json:"owner"`
+	TokenHash string `json:"token_hash"`
+}
+
+// NameStore on-disk subdomain reservations
+type NameStore struct {
+	path         string
+	reservations map[string]Reservation
+	modTime      time.Time
+	mu           sync.RWMutex
+}
+
+// LoadNameStore loads reservations from a JSON file, a missing file is
+// an empty store
+func LoadNameStore(path string) (*NameStore, error) {
+	s := &NameStore{
+		path:         path,
+		reservations: make(map[string]Reservation),
+	}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload re-reads the reservations file, a missing file empties the store
+func (s *NameStore) Reload() error {
+	reservations := make(map[string]Reservation)
+	var modTime time.Time
+	data, err := ioutil.ReadFile(s.path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return err
+	default:
+		if err := json.Unmarshal(data, &reservations); err != nil {
+			return err
+		}
+		if info, err := os.Stat(s.path); err == nil {
+			modTime = info.ModTime()
+		}
+	}
+	s.mu.Lock()
+	s.reservations = reservations
+	s.modTime = modTime
+	s.mu.Unlock()
+	return nil
+}
+
+// Watch reloads the reservations file whenever it changes, so names
+// reserved by another process take effect without a restart. A deleted
+// file empties the store like a missing one at startup, a file that
+// cannot be read keeps the last reservations in force.
+func (s *NameStore) Watch(interval time.Duration) {
+	s.mu.RLock()
+	modTime := s.modTime
+	s.mu.RUnlock()
+	// unreadable the last check failed, the warning is logged once
+	unreadable := false
+	for range time.Tick(interval) {
+		info, err := os.Stat(s.path)
+		switch {
+		case os.IsNotExist(err):
+			unreadable = false
+			if modTime.IsZero() {
+				continue
+			}
+			modTime = time.Time{}
+			s.Reload()
+			common.Logger.Warnw("Reserved names file removed, reservations cleared",
+				"file", s.path,
+			)
+			continue
+		case err != nil:
+			if !unreadable {
+				common.Logger.Warnw("Reserved names file unreadable, keeping the last reservations",
+					"file", s.path,
+					"err", err,
+				)
+			}
+			unreadable = true
+			continue
+		}
+		unreadable = false
+		if info.ModTime().Equal(modTime) {
+			continue
+		}
+		modTime = info.ModTime()
+		if err := s.Reload(); err != nil {
+			common.Logger.Warnw("Reserved names reload failed",
+				"file", s.path,
+				"err", err,
+			)
+			continue
+		}
+		common.Logger.Infow("Reserved names reloaded",
+			"file", s.path,
+		)
+	}
+}
+
+// save writes the store atomically
+func (s *NameStore) save() error {
+	data, err := json.MarshalIndent(s.reservations, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), ".reserved")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// Reserve reserves a name for the holder of token
+func (s *NameStore) Reserve(name, owner, token string) error {
+	if !labelRe.MatchString(name) {
+		return ErrInvalidID
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reservations[name] = Reservation{Owner: owner, TokenHash: auth.HashToken(token)}
+	return s.save()
+}
+
+// Unreserve returns a name to the pool
+func (s *NameStore) Unreserve(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.reservations, name)
+	return s.save()
+}
+
+// Names the reserved names in order
+func (s *NameStore) Names() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, 0, len(s.reservations))
+	for name := range s.reservations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Lookup the reservation of a name
+func (s *NameStore) Lookup(name string) (Reservation, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	r, ok := s.reservations[name]
+	return r, ok
+}
+
+// NamePolicy decides who may claim a custom ID
+type NamePolicy struct {
+	Store    *NameStore
+	denylist map[string]bool
+}
+
+// NewNamePolicy creates a policy, a nil denylist uses DefaultDenylist
+func NewNamePolicy(store *NameStore, denylist []string) *NamePolicy {
+	if denylist == nil {
+		denylist = DefaultDenylist
+	}
+	p := &NamePolicy{
+		Store:    store,
+		denylist: make(map[string]bool, len(denylist)),
+	}
+	for _, name := range denylist {
+		p.denylist[name] = true
+	}
+	return p
+}
+
+// Check whether a client may claim the ID. Reserved IDs are claimed by
+// the owning user or by the holder of the reservation token.
+func (p *NamePolicy) Check(id string, identity *auth.Identity, token string) error {
+	if !labelRe.MatchString(id) {
+		return ErrInvalidID
+	}
+	if p.Store != nil {
+		if r, ok := p.Store.Lookup(id); ok {
+			if identity != nil && r.Owner != "" && identity.Name == r.Owner {
+				return nil
+			}
+			hash := auth.HashToken(token)
+			if token == "" || subtle.ConstantTimeCompare([]byte(hash), []byte(r.TokenHash)) != 1 {
+				return ErrNotOwner
+			}
+			return nil
+		}
+	}
+	if p.denylist[id] {
+		return ErrDeniedID
+	}
+	return nil
+}
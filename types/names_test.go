@@ -0,0 +1,99 @@
+package types
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNameStoreReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "names")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "reserved.json")
+	s, err := LoadNameStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Names()) != 0 {
+		t.Fatalf("names = %v, want none", s.Names())
+	}
+
+	write(t, path, `{"myapp": {"owner": "alice"}}`)
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if r, ok := s.Lookup("myapp"); !ok || r.Owner != "alice" {
+		t.Fatalf("myapp = %+v, %v", r, ok)
+	}
+
+	write(t, path, `{"myapp":`)
+	if err := s.Reload(); err == nil {
+		t.Fatal("reloaded a malformed file")
+	}
+	if _, ok := s.Lookup("myapp"); !ok {
+		t.Fatal("a failed reload dropped the reservations")
+	}
+
+	os.Remove(path)
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Lookup("myapp"); ok {
+		t.Fatal("a removed file kept the reservations")
+	}
+}
+
+func TestNameStoreWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "names")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "reserved.json")
+	write(t, path, `{"one": {"owner": "alice"}}`)
+	s, err := LoadNameStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Watch(5 * time.Millisecond)
+
+	write(t, path, `{"two": {"owner": "bob"}}`)
+	// the modification time may not change within the file system's
+	// resolution, move it explicitly
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(path, later, later)
+	waitFor(t, "the changed file", func() bool {
+		_, ok := s.Lookup("two")
+		return ok
+	})
+	if _, ok := s.Lookup("one"); ok {
+		t.Fatal("reload kept a removed reservation")
+	}
+
+	os.Remove(path)
+	waitFor(t, "the removed file", func() bool {
+		return len(s.Names()) == 0
+	})
+}
+
+func write(t *testing.T, path, data string) {
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitFor polls cond for up to a second
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,65 @@
+package types
+
+import (
+	"strconv"
+	"sync/atomic"
+)
+
+// pendingTable routes responses to the goroutines waiting for them
+type pendingTable map[string]chan *Response
+
+// NewPending allocates a stream ID and a channel for its response
+func (c *Client) NewPending() (string, chan *Response) {
+	id := strconv.FormatUint(atomic.AddUint64(&c.lastStreamID, 1), 10)
+	respChan := make(chan *Response, 1)
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	if c.pending == nil {
+		// the client is gone, nothing will ever answer
+		close(respChan)
+		return id, respChan
+	}
+	c.pending[id] = respChan
+	return id, respChan
+}
+
+// RemovePending forgets a pending request
+func (c *Client) RemovePending(id string) {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	delete(c.pending, id)
+}
+
+// resolvePending delivers a response to its waiting request
+func (c *Client) resolvePending(resp *Response) bool {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	respChan, ok := c.pending[resp.ID]
+	if !ok {
+		return false
+	}
+	delete(c.pending, resp.ID)
+	respChan <- resp
+	return true
+}
+
+// failPending fails a pending request whose RPC could not be sent
+func (c *Client) failPending(id string) {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	if respChan, ok := c.pending[id]; ok {
+		close(respChan)
+		delete(c.pending, id)
+	}
+}
+
+// closePending fails every pending request, the client is gone
+func (c *Client) closePending() {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	for id, respChan := range c.pending {
+		close(respChan)
+		delete(c.pending, id)
+	}
+	c.pending = nil
+}
@@ -0,0 +1,37 @@
+package types
+
+import (
+	"testing"
+)
+
+func TestPending(t *testing.T) {
+	c := NewClient(nil, ModeHTTP)
+
+	id, respChan := c.NewPending()
+	if !c.resolvePending(&Response{ID: id, Type: "http"}) {
+		t.Fatal("response was not delivered")
+	}
+	if resp, ok := <-respChan; !ok || resp.ID != id {
+		t.Fatalf("response = %+v, %v", resp, ok)
+	}
+	if c.resolvePending(&Response{ID: id}) {
+		t.Fatal("a request was answered twice")
+	}
+
+	id, respChan = c.NewPending()
+	c.failPending(id)
+	if _, ok := <-respChan; ok {
+		t.Fatal("failed request got a response")
+	}
+
+	_, respChan = c.NewPending()
+	c.closePending()
+	if _, ok := <-respChan; ok {
+		t.Fatal("pending request survived the client")
+	}
+	// requests made after the client is gone fail right away
+	_, respChan = c.NewPending()
+	if _, ok := <-respChan; ok {
+		t.Fatal("request to a gone client got a response")
+	}
+}
@@ -0,0 +1,199 @@
+package types
+
+import (
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/Defman21/prxpass-server/auth"
+	"github.com/Defman21/prxpass-server/helpers"
+)
+
+const (
+	// EventRegister a client registered a tunnel
+	EventRegister = "register"
+	// EventUnregister a tunnel went away
+	EventUnregister = "unregister"
+)
+
+var (
+	// ErrIDInUse the tunnel ID is reserved or registered by another client
+	ErrIDInUse = errors.New("id in use")
+	// ErrTooManyTunnels the identity reached its max tunnels
+	ErrTooManyTunnels = errors.New("too many tunnels")
+)
+
+// RegistryEvent a change of the registry
+type RegistryEvent struct {
+	Type   string
+	ID     string
+	Client *Client
+}
+
+// Registry a thread-safe registry of tunnels by ID
+type Registry struct {
+	mu          sync.RWMutex
+	clients     map[string]*Client
+	reserved    map[string]bool
+	subscribers []func(RegistryEvent)
+	subMu       sync.RWMutex
+	policy      *NamePolicy
+}
+
+// NewRegistry creates a registry
+func NewRegistry() *Registry {
+	return &Registry{
+		clients:  make(map[string]*Client),
+		reserved: make(map[string]bool),
+	}
+}
+
+// Reserve atomically claims a free ID for a later Register
+func (r *Registry) Reserve(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.clients[id]; exists || r.reserved[id] {
+		return false
+	}
+	r.reserved[id] = true
+	return true
+}
+
+// SetNamePolicy sets the policy applied to custom IDs
+func (r *Registry) SetNamePolicy(policy *NamePolicy) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.policy = policy
+}
+
+// Claim reserves a custom ID requested by a client
+func (r *Registry) Claim(id string, identity *auth.Identity, token string) error {
+	r.mu.RLock()
+	policy := r.policy
+	r.mu.RUnlock()
+	if policy != nil {
+		if err := policy.Check(id, identity, token); err != nil {
+			return err
+		}
+	}
+	if !r.Reserve(id) {
+		return ErrIDInUse
+	}
+	return nil
+}
+
+// Release drops a reservation that was not registered
+func (r *Registry) Release(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.reserved, id)
+}
+
+// Register registers a client under an ID it reserved or that is free.
+// Clients with an identity are limited to its max tunnels.
+func (r *Registry) Register(id string, c *Client) error {
+	r.mu.Lock()
+	if _, exists := r.clients[id]; exists {
+		r.mu.Unlock()
+		return ErrIDInUse
+	}
+	if c.Identity != nil && c.Identity.Permissions.MaxTunnels > 0 &&
+		r.countIdentity(c.Identity.Name) >= c.Identity.Permissions.MaxTunnels {
+		r.mu.Unlock()
+		return ErrTooManyTunnels
+	}
+	delete(r.reserved, id)
+	r.clients[id] = c
+	r.mu.Unlock()
+	r.notify(RegistryEvent{Type: EventRegister, ID: id, Client: c})
+	return nil
+}
+
+// countIdentity tunnels registered by the named identity, the caller
+// holds the lock
+func (r *Registry) countIdentity(name string) int {
+	n := 0
+	for _, c := range r.clients {
+		if c.Identity != nil && c.Identity.Name == name {
+			n++
+		}
+	}
+	return n
+}
+
+// Lookup finds the client of an ID
+func (r *Registry) Lookup(id string) (*Client, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	c, ok := r.clients[id]
+	return c, ok
+}
+
+// Unregister removes an ID if it still belongs to the client
+func (r *Registry) Unregister(id string, c *Client) {
+	r.mu.Lock()
+	delete(r.reserved, id)
+	if current, ok := r.clients[id]; !ok || current != c {
+		r.mu.Unlock()
+		return
+	}
+	delete(r.clients, id)
+	r.mu.Unlock()
+	r.notify(RegistryEvent{Type: EventUnregister, ID: id, Client: c})
+}
+
+// List returns the registered IDs in order
+func (r *Registry) List() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ids := make([]string, 0, len(r.clients))
+	for id := range r.clients {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Subscribe registers a function called on every change. Subscribers run
+// synchronously and must not block.
+func (r *Registry) Subscribe(fn func(RegistryEvent)) {
+	r.subMu.Lock()
+	defer r.subMu.Unlock()
+	r.subscribers = append(r.subscribers, fn)
+}
+
+func (r *Registry) notify(event RegistryEvent) {
+	r.subMu.RLock()
+	defer r.subMu.RUnlock()
+	for _, fn := range r.subscribers {
+		fn(event)
+	}
+}
+
+// maxAllocateAttempts generated IDs tried before giving up
+const maxAllocateAttempts = 100
+
+// ErrIDSpaceExhausted no free ID was generated
+var ErrIDSpaceExhausted = errors.New("could not allocate a unique id")
+
+// Allocate reserves a new unique ID from the generator. IDs the name
+// policy refuses to anonymous clients, denylisted or reserved ones, are
+// skipped.
+func (r *Registry) Allocate(gen helpers.IDGenerator) (string, error) {
+	r.mu.RLock()
+	policy := r.policy
+	r.mu.RUnlock()
+	for i := 0; i < maxAllocateAttempts; i++ {
+		id, err := gen.ID()
+		if err != nil {
+			return "", err
+		}
+		if policy != nil && policy.Check(id, nil, "") != nil {
+			continue
+		}
+		if r.Reserve(id) {
+			return id, nil
+		}
+	}
+	return "", ErrIDSpaceExhausted
+}
@@ -0,0 +1,92 @@
+package types
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Defman21/prxpass-server/auth"
+)
+
+// listIDs generates the listed IDs in order
+type listIDs struct {
+	ids []string
+}
+
+func (g *listIDs) ID() (string, error) {
+	if len(g.ids) == 0 {
+		return "", ErrIDSpaceExhausted
+	}
+	id := g.ids[0]
+	g.ids = g.ids[1:]
+	return id, nil
+}
+
+func TestRegistryAllocateSkipsPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "names")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := LoadNameStore(filepath.Join(dir, "reserved.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Reserve("taken", "alice", ""); err != nil {
+		t.Fatal(err)
+	}
+	r := NewRegistry()
+	r.SetNamePolicy(NewNamePolicy(store, nil))
+	if !r.Reserve("busy") {
+		t.Fatal("busy was not free")
+	}
+
+	id, err := r.Allocate(&listIDs{ids: []string{"admin", "taken", "busy", "free"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "free" {
+		t.Fatalf("id = %q, want %q", id, "free")
+	}
+	if r.Reserve("free") {
+		t.Fatal("allocated id was not reserved")
+	}
+	if _, err := r.Allocate(&listIDs{ids: []string{"admin", "taken"}}); err == nil {
+		t.Fatal("allocated a denied or reserved id")
+	}
+}
+
+func TestRegistryRegister(t *testing.T) {
+	r := NewRegistry()
+	var events []RegistryEvent
+	r.Subscribe(func(e RegistryEvent) { events = append(events, e) })
+	identity := &auth.Identity{Name: "alice", Permissions: auth.Permissions{MaxTunnels: 1}}
+
+	a := NewClient(nil, ModeHTTP)
+	a.Identity = identity
+	if err := r.Register("a", a); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Register("a", NewClient(nil, ModeHTTP)); err != ErrIDInUse {
+		t.Fatalf("err = %v, want %v", err, ErrIDInUse)
+	}
+	b := NewClient(nil, ModeHTTP)
+	b.Identity = identity
+	if err := r.Register("b", b); err != ErrTooManyTunnels {
+		t.Fatalf("err = %v, want %v", err, ErrTooManyTunnels)
+	}
+
+	// a stale client must not unregister the current one
+	r.Unregister("a", b)
+	if c, ok := r.Lookup("a"); !ok || c != a {
+		t.Fatal("a was unregistered by another client")
+	}
+	r.Unregister("a", a)
+	if _, ok := r.Lookup("a"); ok {
+		t.Fatal("a is still registered")
+	}
+	if len(events) != 2 || events[0].Type != EventRegister || events[1].Type != EventUnregister {
+		t.Fatalf("events = %+v", events)
+	}
+}
@@ -0,0 +1,109 @@
+package types
+
+import (
+	"errors"
+	"sort"
+	"sync/atomic"
+
+	"github.com/Defman21/prxpass-server/metrics"
+)
+
+// ErrNoticeUnsupported the transport of the client cannot show notices
+var ErrNoticeUnsupported = errors.New("client cannot receive notices")
+
+// Noticer a stream opener whose transport can show notices to the user
+type Noticer interface {
+	Notice(text string)
+}
+
+// controlRPCs methods Reader handles itself
+var controlRPCs = map[string]bool{
+	"net/hello":     true,
+	"net/register":  true,
+	"net/ping":      true,
+	"net/pong":      true,
+	"net/features":  true,
+	"stream/data":   true,
+	"stream/window": true,
+	"stream/close":  true,
+	"tcp/response":  true,
+	"http/response": true,
+}
+
+// received counts bytes sent by the client
+func (c *Client) received(n int) {
+	atomic.AddUint64(&c.bytesIn, uint64(n))
+	metrics.TunnelBytes.With("in").Add(uint64(n))
+}
+
+// sent counts bytes sent to the client
+func (c *Client) sent(n int) {
+	atomic.AddUint64(&c.bytesOut, uint64(n))
+	metrics.TunnelBytes.With("out").Add(uint64(n))
+}
+
+// countRPC counts an RPC received from the client. Methods nobody
+// handles are counted as unknown so clients cannot create series.
+func (c *Client) countRPC(method string) {
+	if !controlRPCs[method] {
+		c.rpcHandlersMu.RLock()
+		_, ok := c.rpcHandlers[method]
+		c.rpcHandlersMu.RUnlock()
+		if !ok {
+			method = "unknown"
+		}
+	}
+	metrics.RPCs.With(method, "in").Inc()
+}
+
+// Traffic bytes received from and sent to the client
+func (c *Client) Traffic() (in, out uint64) {
+	return atomic.LoadUint64(&c.bytesIn), atomic.LoadUint64(&c.bytesOut)
+}
+
+// Features the enabled features in order
+func (c *Client) Features() []string {
+	c.featuresMu.RLock()
+	defer c.featuresMu.RUnlock()
+	features := make([]string, 0, len(c.features))
+	for feature := range c.features {
+		features = append(features, feature)
+	}
+	sort.Strings(features)
+	return features
+}
+
+// Notice shows a message to the user of the client, as a net/notice RPC
+// or through the transport of its stream opener
+func (c *Client) Notice(text string) error {
+	if c.opener != nil {
+		n, ok := c.opener.(Noticer)
+		if !ok {
+			return ErrNoticeUnsupported
+		}
+		n.Notice(text)
+		return nil
+	}
+	return c.Send(c.NewRPC("net/notice", "", nil, text))
+}
+
+// countedStream counts the traffic of a stream opened by a stream opener
+type countedStream struct {
+	StreamConn
+	client *Client
+}
+
+func (s *countedStream) Read(p []byte) (int, error) {
+	n, err := s.StreamConn.Read(p)
+	if n > 0 {
+		s.client.received(n)
+		s.client.seen()
+	}
+	return n, err
+}
+
+func (s *countedStream) Write(p []byte) (int, error) {
+	n, err := s.StreamConn.Write(p)
+	s.client.sent(n)
+	return n, err
+}
@@ -0,0 +1,363 @@
+package types
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Defman21/prxpass-server/common"
+)
+
+const (
+	// StreamWindowSize initial flow-control window of a stream
+	StreamWindowSize = 256 << 10
+	// StreamChunkSize largest payload of a single stream/data frame
+	StreamChunkSize = 32 << 10
+	// maxStreamWindow largest send window a peer may grant, as in HTTP/2
+	maxStreamWindow = 1<<31 - 1
+)
+
+var (
+	// ErrStreamClosed the stream was closed locally
+	ErrStreamClosed = errors.New("stream closed")
+	// ErrStreamReset the stream was aborted
+	ErrStreamReset = errors.New("stream reset")
+	// ErrStreamsUnsupported the client did not enable stream multiplexing
+	ErrStreamsUnsupported = errors.New("client does not support streams")
+)
+
+// streamTable open streams of a client
+type streamTable map[string]*Stream
+
+// StreamConn a stream opened to a client, whatever carries it
+type StreamConn interface {
+	io.ReadWriteCloser
+	// ID identifies the stream in logs
+	ID() string
+	// CloseWrite half-closes the stream
+	CloseWrite() error
+	// Reset aborts the stream in both directions
+	Reset() error
+}
+
+// StreamOpener opens streams over a transport other than the control
+// connection, such as an SSH connection
+type StreamOpener interface {
+	OpenStream(kind string, args ...string) (StreamConn, error)
+}
+
+// Stream a logical stream multiplexed over the control connection
+type Stream struct {
+	id     string
+	Kind   string
+	client *Client
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	buf  bytes.Buffer
+	// recvWindow bytes the peer may still send
+	recvWindow uint32
+	// consumed bytes read since the last window update
+	consumed uint32
+	// sendWindow bytes we may still send
+	sendWindow  uint32
+	remoteClose bool
+	localClose  bool
+	reset       bool
+}
+
+func newStream(c *Client, id, kind string) *Stream {
+	s := &Stream{
+		id:         id,
+		Kind:       kind,
+		client:     c,
+		recvWindow: StreamWindowSize,
+		sendWindow: StreamWindowSize,
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// ID the stream ID
+func (s *Stream) ID() string {
+	return s.id
+}
+
+// OpenStream opens a new stream to the client
+func (c *Client) OpenStream(kind string, args ...string) (StreamConn, error) {
+	if !c.Supports(FeatureStreams) {
+		return nil, ErrStreamsUnsupported
+	}
+	if c.opener != nil {
+		stream, err := c.opener.OpenStream(kind, args...)
+		if err != nil {
+			return nil, err
+		}
+		return &countedStream{StreamConn: stream, client: c}, nil
+	}
+	id := strconv.FormatUint(atomic.AddUint64(&c.lastStreamID, 1), 10)
+	s := newStream(c, id, kind)
+	c.streamsMu.Lock()
+	if c.streams == nil {
+		c.streamsMu.Unlock()
+		return nil, ErrStreamReset
+	}
+	c.streams[id] = s
+	c.streamsMu.Unlock()
+
+	err := c.Send(c.NewRPC("stream/open", id, nil, append([]string{kind}, args...)...))
+	if err != nil {
+		c.removeStream(id)
+		return nil, err
+	}
+	common.Logger.Infow("Stream opened",
+		"stream", id,
+		"kind", kind,
+	)
+	return s, nil
+}
+
+func (c *Client) lookupStream(id string) *Stream {
+	c.streamsMu.Lock()
+	defer c.streamsMu.Unlock()
+	return c.streams[id]
+}
+
+func (c *Client) removeStream(id string) {
+	c.streamsMu.Lock()
+	defer c.streamsMu.Unlock()
+	delete(c.streams, id)
+}
+
+// closeStreams resets every stream, the client is gone
+func (c *Client) closeStreams() {
+	c.streamsMu.Lock()
+	streams := c.streams
+	c.streams = nil
+	c.streamsMu.Unlock()
+	for _, s := range streams {
+		s.abort()
+	}
+}
+
+// handleStreamRPC dispatches stream/* RPCs sent by the client
+func (c *Client) handleStreamRPC(msg *Message) {
+	streamID, args, ok := msg.StreamRef()
+	if !ok {
+		common.Logger.Warnw("Malformed stream RPC",
+			"method", msg.Method,
+		)
+		return
+	}
+	s := c.lookupStream(streamID)
+	if s == nil {
+		common.Logger.Warnw("RPC for unknown stream",
+			"method", msg.Method,
+			"stream", streamID,
+		)
+		return
+	}
+	switch msg.Method {
+	case "stream/data":
+		data, _, ok := msg.Payload(args)
+		if !ok {
+			return
+		}
+		if !s.receive(data) {
+			common.Logger.Warnw("Stream window exceeded",
+				"stream", s.id,
+			)
+			s.Reset()
+		}
+	case "stream/window":
+		if len(args) < 1 {
+			return
+		}
+		inc, err := strconv.ParseUint(args[0], 10, 32)
+		if err != nil {
+			common.Logger.Warnw("Malformed window update",
+				"stream", s.id,
+				"err", err,
+			)
+			return
+		}
+		if !s.grow(uint32(inc)) {
+			common.Logger.Warnw("Stream window overflow",
+				"stream", s.id,
+				"increment", inc,
+			)
+			s.Reset()
+		}
+	case "stream/close":
+		if len(args) > 0 {
+			// a reason means the client aborted the stream
+			s.abort()
+			c.removeStream(s.id)
+			return
+		}
+		s.mu.Lock()
+		s.remoteClose = true
+		done := s.localClose
+		s.cond.Broadcast()
+		s.mu.Unlock()
+		if done {
+			c.removeStream(s.id)
+		}
+	}
+}
+
+func (s *Stream) receive(data []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.reset || s.remoteClose {
+		return true
+	}
+	if uint32(len(data)) > s.recvWindow {
+		return false
+	}
+	s.recvWindow -= uint32(len(data))
+	s.buf.Write(data)
+	s.cond.Broadcast()
+	return true
+}
+
+// grow adds a window update, false when it would take the send window
+// past maxStreamWindow
+func (s *Stream) grow(inc uint32) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if uint64(s.sendWindow)+uint64(inc) > maxStreamWindow {
+		return false
+	}
+	s.sendWindow += inc
+	s.cond.Broadcast()
+	return true
+}
+
+func (s *Stream) abort() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reset = true
+	s.cond.Broadcast()
+}
+
+func (s *Stream) send(method string, body []byte, args ...string) error {
+	return s.client.Send(s.client.NewRPC(method, s.id, body, args...))
+}
+
+// Read reads data sent by the client
+func (s *Stream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	for s.buf.Len() == 0 && !s.remoteClose && !s.reset {
+		s.cond.Wait()
+	}
+	if s.buf.Len() == 0 {
+		defer s.mu.Unlock()
+		if s.reset {
+			return 0, ErrStreamReset
+		}
+		return 0, io.EOF
+	}
+	n, _ := s.buf.Read(p)
+	s.consumed += uint32(n)
+	var inc uint32
+	if s.consumed >= StreamWindowSize/2 && !s.remoteClose {
+		inc = s.consumed
+		s.recvWindow += inc
+		s.consumed = 0
+	}
+	s.mu.Unlock()
+
+	if inc > 0 {
+		if err := s.send("stream/window", nil, strconv.FormatUint(uint64(inc), 10)); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Write sends data to the client, blocking while the send window is exhausted
+func (s *Stream) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		s.mu.Lock()
+		for s.sendWindow == 0 && !s.localClose && !s.reset {
+			s.cond.Wait()
+		}
+		if s.reset {
+			s.mu.Unlock()
+			return written, ErrStreamReset
+		}
+		if s.localClose {
+			s.mu.Unlock()
+			return written, ErrStreamClosed
+		}
+		n := len(p) - written
+		if n > StreamChunkSize {
+			n = StreamChunkSize
+		}
+		if uint32(n) > s.sendWindow {
+			n = int(s.sendWindow)
+		}
+		s.sendWindow -= uint32(n)
+		s.mu.Unlock()
+
+		if err := s.send("stream/data", p[written:written+n]); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// CloseWrite half-closes the stream, the client sees the end of data
+func (s *Stream) CloseWrite() error {
+	s.mu.Lock()
+	if s.localClose || s.reset {
+		s.mu.Unlock()
+		return nil
+	}
+	s.localClose = true
+	done := s.remoteClose
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	if done {
+		s.client.removeStream(s.id)
+	}
+	return s.send("stream/close", nil)
+}
+
+// Close closes the stream, aborting it if the client is still sending
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	reset, remoteClose, localClose := s.reset, s.remoteClose, s.localClose
+	s.mu.Unlock()
+	switch {
+	case reset:
+		s.client.removeStream(s.id)
+		return nil
+	case !remoteClose:
+		return s.Reset()
+	case !localClose:
+		return s.CloseWrite()
+	}
+	s.client.removeStream(s.id)
+	return nil
+}
+
+// Reset aborts the stream in both directions
+func (s *Stream) Reset() error {
+	s.mu.Lock()
+	if s.reset {
+		s.mu.Unlock()
+		return nil
+	}
+	s.reset = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	s.client.removeStream(s.id)
+	return s.send("stream/close", nil, "reset")
+}
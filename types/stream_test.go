@@ -0,0 +1,161 @@
+package types
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// pipeClient a client on one end of a pipe, the messages it sends arrive
+// on the returned channel
+func pipeClient(t *testing.T) (*Client, <-chan *Message) {
+	server, peer := net.Pipe()
+	c := NewClient(server, ModeHTTP)
+	c.enableFeatures([]string{FeatureStreams})
+	msgs := make(chan *Message, 64)
+	go func() {
+		defer close(msgs)
+		decoder := NewFrameDecoder(peer, 0)
+		for {
+			frame, err := decoder.Next()
+			if err != nil {
+				return
+			}
+			msg, _, err := ParseMessage(frame)
+			if err != nil || msg == nil {
+				continue
+			}
+			msgs <- msg
+		}
+	}()
+	t.Cleanup(func() {
+		server.Close()
+		peer.Close()
+	})
+	return c, msgs
+}
+
+// expect the next message the client sent
+func expect(t *testing.T, msgs <-chan *Message, method string) *Message {
+	select {
+	case msg := <-msgs:
+		if msg.Method != method {
+			t.Fatalf("method = %q, want %q", msg.Method, method)
+		}
+		return msg
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for %s", method)
+	}
+	return nil
+}
+
+// rpc a version 1 stream RPC from the client
+func rpc(method, streamID string, args ...string) *Message {
+	return &Message{
+		Version: ProtocolVersion1,
+		RPC:     RPC{Method: method, Args: append([]string{streamID}, args...)},
+	}
+}
+
+func openStream(t *testing.T) (*Client, *Stream, <-chan *Message) {
+	c, msgs := pipeClient(t)
+	conn, err := c.OpenStream("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, msgs, "stream/open")
+	return c, conn.(*Stream), msgs
+}
+
+func TestStreamSendWindow(t *testing.T) {
+	c, s, msgs := openStream(t)
+
+	written := make(chan error, 1)
+	go func() {
+		_, err := s.Write(make([]byte, StreamWindowSize+10))
+		written <- err
+	}()
+	sent := 0
+	for sent < StreamWindowSize {
+		msg := expect(t, msgs, "stream/data")
+		body, _, _ := msg.Payload(msg.Args[1:])
+		sent += len(body)
+	}
+	if sent != StreamWindowSize {
+		t.Fatalf("sent %d bytes, want the window of %d", sent, StreamWindowSize)
+	}
+	select {
+	case err := <-written:
+		t.Fatalf("write returned past the window: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	c.handleStreamRPC(rpc("stream/window", s.ID(), "10"))
+	msg := expect(t, msgs, "stream/data")
+	if body, _, _ := msg.Payload(msg.Args[1:]); len(body) != 10 {
+		t.Fatalf("sent %d bytes after the update, want 10", len(body))
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStreamWindowOverflow(t *testing.T) {
+	c, s, msgs := openStream(t)
+
+	inc := strconv.FormatUint(maxStreamWindow-StreamWindowSize, 10)
+	c.handleStreamRPC(rpc("stream/window", s.ID(), inc))
+	if s.sendWindow != maxStreamWindow {
+		t.Fatalf("window = %d, want %d", s.sendWindow, maxStreamWindow)
+	}
+
+	// one more byte is past the maximum, the stream is reset
+	c.handleStreamRPC(rpc("stream/window", s.ID(), "1"))
+	msg := expect(t, msgs, "stream/close")
+	if len(msg.Args) < 2 || msg.Args[1] != "reset" {
+		t.Fatalf("args = %v, want a reset", msg.Args)
+	}
+	if c.lookupStream(s.ID()) != nil {
+		t.Fatal("the reset stream is still open")
+	}
+	if _, err := s.Write([]byte("x")); err != ErrStreamReset {
+		t.Fatalf("err = %v, want %v", err, ErrStreamReset)
+	}
+}
+
+func TestStreamReceiveWindow(t *testing.T) {
+	c, s, msgs := openStream(t)
+
+	half := string(make([]byte, StreamWindowSize/2))
+	c.handleStreamRPC(rpc("stream/data", s.ID(), half))
+	c.handleStreamRPC(rpc("stream/data", s.ID(), half))
+	if s.recvWindow != 0 {
+		t.Fatalf("window = %d, want 0", s.recvWindow)
+	}
+
+	// reading half the window grants it back to the client
+	buf := make([]byte, StreamWindowSize/2)
+	read := 0
+	for read < len(buf) {
+		n, err := s.Read(buf[read:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		read += n
+	}
+	msg := expect(t, msgs, "stream/window")
+	if want := strconv.Itoa(StreamWindowSize / 2); len(msg.Args) < 2 || msg.Args[1] != want {
+		t.Fatalf("args = %v, want an update of %s", msg.Args, want)
+	}
+	if s.recvWindow != StreamWindowSize/2 {
+		t.Fatalf("window = %d, want %d", s.recvWindow, StreamWindowSize/2)
+	}
+
+	// data past the window resets the stream
+	c.handleStreamRPC(rpc("stream/data", s.ID(), half+"x"))
+	expect(t, msgs, "stream/close")
+	if c.lookupStream(s.ID()) != nil {
+		t.Fatal("the stream survived an overrun")
+	}
+}
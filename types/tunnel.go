@@ -0,0 +1,79 @@
+package types
+
+import (
+	"errors"
+)
+
+const (
+	// ModeHTTP clients exposed as HTTP subdomains
+	ModeHTTP = "http"
+	// ModeTCP clients exposed as raw TCP ports
+	ModeTCP = "tcp"
+	// ModeUDP clients exposed as UDP ports
+	ModeUDP = "udp"
+)
+
+// ErrUnknownMode no tunnel handler is registered for the client mode
+var ErrUnknownMode = errors.New("unknown tunnel mode")
+
+// TunnelHandler exposes registered clients of a non-HTTP mode to the public
+type TunnelHandler interface {
+	// Listen starts serving the client and returns its public address.
+	// params are the net/register parameters sent by the client.
+	Listen(c *Client, id string, params map[string]string) (string, error)
+}
+
+var tunnelHandlers = make(map[string]TunnelHandler)
+
+// RegisterTunnelHandler registers a handler for a client mode
+func RegisterTunnelHandler(mode string, handler TunnelHandler) {
+	tunnelHandlers[mode] = handler
+}
+
+// Listen exposes the client through the handler of its mode
+func (c *Client) Listen(id string, params map[string]string) (string, error) {
+	handler, ok := tunnelHandlers[c.Mode]
+	if !ok {
+		return "", ErrUnknownMode
+	}
+	return handler.Listen(c, id, params)
+}
+
+// OnClose registers a function called once the client disconnects
+func (c *Client) OnClose(fn func()) {
+	c.closersMu.Lock()
+	defer c.closersMu.Unlock()
+	c.closers = append(c.closers, fn)
+}
+
+func (c *Client) runClosers() {
+	c.closersMu.Lock()
+	closers := c.closers
+	c.closers = nil
+	c.closersMu.Unlock()
+	for _, fn := range closers {
+		fn()
+	}
+}
+
+// HandleRPC registers a handler for an RPC method sent by the client
+func (c *Client) HandleRPC(method string, fn func(msg *Message)) {
+	c.rpcHandlersMu.Lock()
+	defer c.rpcHandlersMu.Unlock()
+	if c.rpcHandlers == nil {
+		c.rpcHandlers = make(map[string]func(msg *Message))
+	}
+	c.rpcHandlers[method] = fn
+}
+
+// dispatchRPC calls the handler registered for the RPC method
+func (c *Client) dispatchRPC(msg *Message) bool {
+	c.rpcHandlersMu.RLock()
+	fn, ok := c.rpcHandlers[msg.Method]
+	c.rpcHandlersMu.RUnlock()
+	if !ok {
+		return false
+	}
+	fn(msg)
+	return true
+}
@@ -4,8 +4,13 @@ import (
 	"bytes"
 	"fmt"
 	"net"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/Defman21/prxpass-server/auth"
 	"github.com/Defman21/prxpass-server/common"
+	"github.com/Defman21/prxpass-server/metrics"
 	"github.com/vmihailenco/msgpack"
 )
 
@@ -15,63 +20,133 @@ type RPC struct {
 	Args   []string
 }
 
-// Message a message
+// Message a message. Fields after RPC are only used by version 2.
 type Message struct {
 	Sender  string
 	Version int
 	RPC
+	StreamID     uint64              `msgpack:",omitempty"`
+	Status       int                 `msgpack:",omitempty"`
+	Headers      map[string][]string `msgpack:",omitempty"`
+	Body         []byte              `msgpack:",omitempty"`
+	Params       map[string]string   `msgpack:",omitempty"`
+	Versions     []int               `msgpack:",omitempty"`
+	Capabilities []string            `msgpack:",omitempty"`
 }
 
 // Client a client
 type Client struct {
-	Conn     net.Conn
-	Request  chan *Request
-	Response chan *Response
-	Close    chan bool
+	lastStreamID  uint64
+	lastSeen      int64
+	bytesIn       uint64
+	bytesOut      uint64
+	version       int32
+	Conn          net.Conn
+	Mode          string
+	Identity      *auth.Identity
+	ConnectedAt   time.Time
+	Request       chan *Request
+	Close         chan bool
+	writeMu       sync.Mutex
+	pending       pendingTable
+	pendingMu     sync.Mutex
+	streams       streamTable
+	streamsMu     sync.Mutex
+	features      map[string]bool
+	featuresMu    sync.RWMutex
+	closers       []func()
+	closersMu     sync.Mutex
+	rpcHandlers   map[string]func(msg *Message)
+	rpcHandlersMu sync.RWMutex
+	opener        StreamOpener
 }
 
 // NewClient creates a client struct
-func NewClient(con net.Conn) *Client {
+func NewClient(con net.Conn, mode string) *Client {
 	return &Client{
-		Conn:     con,
-		Request:  make(chan *Request),
-		Response: make(chan *Response),
-		Close:    make(chan bool),
+		Conn:        con,
+		Mode:        mode,
+		ConnectedAt: time.Now(),
+		Request:     make(chan *Request),
+		Close:       make(chan bool),
+		pending:     make(pendingTable),
+		streams:     make(streamTable),
+		features:    make(map[string]bool),
 	}
 }
 
-// Clients a list of clients
-type Clients map[string]*Client
+// NewStreamClient creates a client whose streams are opened by opener
+// instead of the control protocol. It supports streams, upgrades and TCP
+// tunnels and never runs Reader or Writer.
+func NewStreamClient(con net.Conn, mode string, identity *auth.Identity, opener StreamOpener) *Client {
+	c := NewClient(con, mode)
+	c.Identity = identity
+	c.opener = opener
+	c.seen()
+	c.enableFeatures([]string{FeatureStreams, FeatureWebSockets, FeatureTCP})
+	return c
+}
+
+// Disconnected releases the tunnel of a client whose connection is gone
+func (c *Client) Disconnected(registry *Registry, id string) {
+	c.Conn.Close()
+	registry.Unregister(id, c)
+	c.closePending()
+	c.closeStreams()
+	c.runClosers()
+	close(c.Close)
+}
 
-// Request a request
+// Request a request. Version 1 clients get the raw Data, version 2
+// clients the structured fields.
 type Request struct {
-	Type string
-	Data []byte
+	ID      string
+	Type    string
+	Data    []byte
+	Method  string
+	URL     string
+	Proto   string
+	Headers map[string][]string
+	Body    []byte
 }
 
-// Response a response
+// Response a response. Version 1 clients send the raw Data, version 2
+// clients the structured fields.
 type Response struct {
-	Type string
-	Data []byte
+	ID      string
+	Type    string
+	Data    []byte
+	Status  int
+	Headers map[string][]string
+	Body    []byte
 }
 
-// Writer a writing goroutine
-func (c *Client) Writer(id string, config *HTTPConfig) {
+// Send writes a message frame to the connection
+func (c *Client) Send(msg *Message) error {
+	msgBytes, err := NewMessage(msg)
+	if err != nil {
+		return err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	n, err := c.Conn.Write(msgBytes)
+	c.sent(n)
+	if err != nil {
+		return err
+	}
+	metrics.RPCs.With(msg.Method, "out").Inc()
+	return nil
+}
+
+// Writer a writing goroutine, address is the public address of the tunnel
+func (c *Client) Writer(id string, address string) {
 	common.Logger.Infow("Writing goroutine created",
 		"id", id,
 	)
-	url := fmt.Sprintf("http://%s.%s:%d/", id, config.Host, config.ServerPort)
-	msgBytes, err := NewMessage(&Message{
-		Sender:  "server",
-		Version: 1,
-		RPC: RPC{
-			Method: "net/notify",
-			Args:   []string{id, url},
-		},
-	})
+	err := c.Send(c.NewRPC("net/notify", "", nil, id, address))
 
 	if err != nil {
-		common.Logger.Warnw("helpers.NewMessage error",
+		common.Logger.Warnw("Send error",
 			"err", err,
 			"id", id,
 		)
@@ -81,38 +156,38 @@ func (c *Client) Writer(id string, config *HTTPConfig) {
 	common.Logger.Infow("RPC",
 		"id", id,
 		"method", "net/notify",
-		"args", []string{id, url},
+		"args", []string{id, address},
 	)
 
-	c.Conn.Write(msgBytes)
-
 	for {
 		select {
 		case reqChan := <-c.Request:
 			common.Logger.Infow("Info",
 				"id", id,
 				"type", reqChan.Type,
+				"stream", reqChan.ID,
 			)
-			msgBytes, err := NewMessage(&Message{
-				Sender:  "server",
-				Version: 1,
-				RPC: RPC{
-					Method: fmt.Sprintf("%v/request", reqChan.Type),
-					Args:   []string{string(reqChan.Data)},
-				},
-			})
+			method := fmt.Sprintf("%v/request", reqChan.Type)
+			msg := c.NewRPC(method, reqChan.ID, reqChan.Data)
+			if c.Version() >= ProtocolVersion2 {
+				msg = c.NewRPC(method, reqChan.ID, reqChan.Body, reqChan.Method, reqChan.URL, reqChan.Proto)
+				msg.Headers = reqChan.Headers
+			}
+			err := c.Send(msg)
 			if err != nil {
-				common.Logger.Warnw("helpers.NewMessage error",
+				common.Logger.Warnw("Send error",
 					"id", id,
 					"err", err,
 				)
+				// the visitor gets a 502 instead of waiting for an
+				// answer that never comes
+				c.failPending(reqChan.ID)
 				continue
 			}
 			common.Logger.Infow("RPC",
 				"id", id,
-				"method", fmt.Sprintf("%v/request", reqChan.Type),
+				"method", method,
 			)
-			c.Conn.Write(msgBytes)
 		case <-c.Close:
 			common.Logger.Warnw("Writing goroutine destroyed",
 				"id", id,
@@ -123,27 +198,47 @@ func (c *Client) Writer(id string, config *HTTPConfig) {
 	}
 }
 
-// Reader reading goroutine
-func (c *Client) Reader(clients *Clients, id string, config *HTTPConfig) {
-	password := config.Password
-	customIDs := config.CustomIDs
+// Reader reading goroutine. The authenticator checks the credentials of
+// net/register.
+func (c *Client) Reader(registry *Registry, id string, config *Config, authenticator auth.Authenticator) {
+	customIDs := config.HTTP.CustomIDs
 	common.Logger.Infow("Reading goroutine created",
 		"id", id,
+		"mode", c.Mode,
 	)
-	responseBytes := make([]byte, 1024)
+	c.seen()
+	interval, timeout := HeartbeatDurations(&config.HTTP)
+	go c.heartbeat(id, interval, timeout)
+	clientID := id
+	// a peer that never reads must not pin the goroutine on the first write
+	c.Conn.SetWriteDeadline(time.Now().Add(HandshakeTimeout))
+	nonce, err := c.challenge(clientID)
+	c.Conn.SetWriteDeadline(time.Time{})
+	if err != nil {
+		common.Logger.Warnw("Challenge failed",
+			"id", id,
+			"err", err,
+		)
+		c.Disconnected(registry, id)
+		return
+	}
+	// registered a connection owns a single tunnel, Disconnected only
+	// releases that one
+	registered := false
+	decoder := NewFrameDecoder(c.Conn, config.HTTP.MaxFrameSize)
 	for {
-		n, err := c.Conn.Read(responseBytes)
+		frame, err := decoder.Next()
 		if err != nil {
 			common.Logger.Warnw("Reading goroutine destroyed",
 				"id", id,
 				"reason", err,
 			)
-			c.Conn.Close()
-			delete(*clients, id)
-			c.Close <- true
+			c.Disconnected(registry, id)
 			return
 		}
-		msgObj, isMsgpack, err := ParseMessage(responseBytes[:n])
+		c.seen()
+		c.received(len(frame) + frameHeaderSize)
+		msgObj, isMsgpack, err := ParseMessage(frame)
 		if err != nil {
 			common.Logger.Warnw("ParseMessage failed",
 				"id", id,
@@ -152,88 +247,205 @@ func (c *Client) Reader(clients *Clients, id string, config *HTTPConfig) {
 			continue
 		}
 		if isMsgpack {
+			c.countRPC(msgObj.RPC.Method)
+			if msgObj.RPC.Method == "net/hello" {
+				common.Logger.Infow("RPC",
+					"id", id,
+					"method", "net/hello",
+					"versions", msgObj.Versions,
+					"capabilities", msgObj.Capabilities,
+				)
+				if err := c.hello(msgObj); err != nil {
+					common.Logger.Warnw("Handshake rejected",
+						"id", id,
+						"err", err,
+					)
+					c.reject("net/reject", err.Error())
+				}
+				continue
+			}
+			if err := c.checkVersion(msgObj.Version); err != nil {
+				common.Logger.Warnw("Message rejected",
+					"id", id,
+					"method", msgObj.RPC.Method,
+					"err", err,
+				)
+				c.reject("net/reject", err.Error())
+				continue
+			}
 			switch msgObj.RPC.Method {
 			case "net/register":
+				if registered {
+					common.Logger.Warnw("Register rejected",
+						"id", id,
+						"err", ErrAlreadyRegistered,
+					)
+					c.Send(c.NewRPC("net/reject", "", nil, ErrAlreadyRegistered.Error()))
+					continue
+				}
+				params := registerParams(msgObj)
+				cid := params["id"]
 				common.Logger.Warnw("RPC",
 					"con", c.Conn,
 					"method", "net/register",
-					"args", msgObj.RPC.Args,
+					"requested", cid,
 				)
-				cid := msgObj.RPC.Args[0]
-				if password != "" {
-					upass := msgObj.RPC.Args[1]
-					if upass != password {
-						common.Logger.Warnw("Password mismatch",
-							"password", password,
-							"client_password", upass,
-						)
-						msgBytes, _ := NewMessage(&Message{
-							Sender:  "server",
-							Version: 1,
-							RPC: RPC{
-								Method: "net/auth-reject",
-								Args:   []string{"Password mismatch"},
-							},
-						})
-						c.Conn.Write(msgBytes)
-						c.Conn.Close()
-						common.Logger.Warnw("Writing goroutine destroyed",
-							"id", id,
-							"reason", "Password mismatch",
-						)
-						return
-					}
+				identity, err := c.authenticate(authenticator, &auth.Credentials{
+					ID:       cid,
+					User:     params["user"],
+					Password: params["password"],
+					Token:    params["token"],
+					Mode:     c.Mode,
+					Nonce:    nonce,
+					ClientID: clientID,
+					Response: params["response"],
+				})
+				if err != nil {
+					common.Logger.Warnw("Authentication failed",
+						"id", id,
+						"remote", c.Conn.RemoteAddr().String(),
+						"err", err,
+					)
+					metrics.AuthFailures.With("control").Inc()
+					c.reject("net/auth-reject", "Authentication failed")
+					continue
+				}
+				if !identity.Permissions.AllowsType(c.Mode) {
+					common.Logger.Warnw("Tunnel type not permitted",
+						"id", id,
+						"user", identity.Name,
+						"mode", c.Mode,
+					)
+					c.reject("net/auth-reject", "Tunnel type not permitted")
+					continue
 				}
-				if customIDs {
-					if _, exists := (*clients)[cid]; exists {
+				c.Identity = identity
+				common.Logger.Infow("Authenticated",
+					"id", id,
+					"user", identity.Name,
+				)
+				if customIDs && cid != "" && cid != id {
+					if err := registry.Claim(cid, c.Identity, params["reserve_token"]); err != nil {
 						common.Logger.Warnw("Custom ID request rejected",
 							"id", id,
-							"reason", "in use",
+							"requested", cid,
+							"reason", err,
 						)
 					} else {
 						common.Logger.Infow("Custom ID request accepted",
 							"oldId", id,
 							"newId", cid,
 						)
+						registry.Release(id)
 						id = cid
 					}
-				} else {
+				} else if !customIDs {
 					common.Logger.Warn("Custom IDs are disabled")
 				}
-				(*clients)[id] = c
+				if !identity.Permissions.AllowsSubdomain(id) {
+					common.Logger.Warnw("Subdomain not permitted",
+						"id", id,
+						"user", identity.Name,
+					)
+					c.reject("net/auth-reject", "Subdomain not permitted")
+					continue
+				}
+				address := config.HTTPAddress(id)
+				if c.Mode != ModeHTTP {
+					address, err = c.Listen(id, params)
+					if err != nil {
+						common.Logger.Warnw("Listen failed",
+							"id", id,
+							"mode", c.Mode,
+							"err", err,
+						)
+						c.reject("net/auth-reject", err.Error())
+						continue
+					}
+				}
+				if err := registry.Register(id, c); err != nil {
+					common.Logger.Warnw("Register failed",
+						"id", id,
+						"err", err,
+					)
+					c.reject("net/auth-reject", err.Error())
+					continue
+				}
+				registered = true
 				common.Logger.Infow("Registered a client",
 					"id", id,
+					"mode", c.Mode,
+					"address", address,
 				)
-				go c.Writer(id, config)
-			case "tcp/response":
+				go c.Writer(id, address)
+			case "net/ping":
+				c.Send(c.NewRPC("net/pong", "", nil, msgObj.RPC.Args...))
+			case "net/pong":
+				// any message refreshes the last seen time
+			case "net/features":
+				enabled := c.enableFeatures(msgObj.RPC.Args)
 				common.Logger.Infow("RPC",
 					"id", id,
-					"method", "tcp/response",
+					"method", "net/features",
+					"args", msgObj.RPC.Args,
+					"enabled", enabled,
 				)
-				responseStr := msgObj.RPC.Args[0]
-				c.Response <- &Response{Type: "tcp", Data: []byte(responseStr)}
-			case "http/response":
+				c.Send(c.NewRPC("net/features", "", nil, enabled...))
+			case "stream/data", "stream/window", "stream/close":
+				c.handleStreamRPC(msgObj)
+			case "tcp/response", "http/response":
 				common.Logger.Infow("RPC",
 					"id", id,
-					"method", "http/response",
+					"method", msgObj.RPC.Method,
 				)
-				responseStr := msgObj.RPC.Args[0]
-				c.Response <- &Response{Type: "http", Data: []byte(responseStr)}
+				streamID, args, ok := msgObj.StreamRef()
+				body, _, hasBody := msgObj.Payload(args)
+				if !ok || !hasBody {
+					common.Logger.Warnw("Malformed response",
+						"id", id,
+						"method", msgObj.RPC.Method,
+					)
+					continue
+				}
+				resp := &Response{
+					ID:   streamID,
+					Type: strings.TrimSuffix(msgObj.RPC.Method, "/response"),
+				}
+				if msgObj.Version >= ProtocolVersion2 {
+					resp.Status = msgObj.Status
+					resp.Headers = msgObj.Headers
+					resp.Body = body
+				} else {
+					resp.Data = body
+				}
+				if !c.resolvePending(resp) {
+					common.Logger.Warnw("Response for unknown stream",
+						"id", id,
+						"stream", resp.ID,
+					)
+				}
+			default:
+				if !c.dispatchRPC(msgObj) {
+					common.Logger.Warnw("Unknown RPC",
+						"id", id,
+						"method", msgObj.RPC.Method,
+					)
+				}
 			}
 		}
 	}
 }
 
-// NewMessage create a msgpack message
+// NewMessage create a length-prefixed msgpack message frame
 func NewMessage(obj *Message) ([]byte, error) {
 	msgpBytes, err := msgpack.Marshal(obj)
 	if err != nil {
 		return nil, err
 	}
-	return append([]byte("!msgpack:"), msgpBytes...), nil
+	return EncodeFrame(append([]byte("!msgpack:"), msgpBytes...), DefaultMaxFrameSize)
 }
 
-// ParseMessage parse a msgpack message
+// ParseMessage parse a msgpack message frame payload
 func ParseMessage(msg []byte) (*Message, bool, error) {
 	if bytes.HasPrefix(msg, []byte("!msgpack:")) {
 		var obj Message